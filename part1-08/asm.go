@@ -0,0 +1,856 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// assembler for the NASM subset our disassembler emits, plus labels,
+// `db`, `dw` and `times`
+//
+// Encodings follow what nasm picks by default, so reassembling our
+// disassembly of a nasm binary gives back the exact same bytes.
+
+type Program struct {
+	code   []byte
+	labels map[string]int
+	// in source order
+	labelNames []string
+	// instruction and data lines in source order
+	lines []SourceLine
+}
+
+type SourceLine struct {
+	// 1-based
+	line   int
+	offset int
+	size   int
+	text   string
+	// `db` or `dw`, not instructions
+	data bool
+}
+
+// offset of the label, or -1
+func (p *Program) label(name string) int {
+	offset, ok := p.labels[name]
+	if !ok {
+		return -1
+	}
+	return offset
+}
+
+// the first label in the source at offset, or ""
+func (p *Program) labelAt(offset int) string {
+	for _, name := range p.labelNames {
+		if p.labels[name] == offset {
+			return name
+		}
+	}
+	return ""
+}
+
+// source line of the instruction at offset, or nil
+func (p *Program) lineAt(offset int) *SourceLine {
+	idx := sort.Search(len(p.lines), func(i int) bool {
+		return p.lines[i].offset+p.lines[i].size > offset
+	})
+
+	if idx < len(p.lines) && p.lines[idx].offset <= offset {
+		return &p.lines[idx]
+	}
+
+	return nil
+}
+
+// first instruction line at or after the 1-based line, or nil
+func (p *Program) lineFrom(line int) *SourceLine {
+	idx := sort.Search(len(p.lines), func(i int) bool {
+		return p.lines[i].line >= line
+	})
+
+	if idx < len(p.lines) {
+		return &p.lines[idx]
+	}
+
+	return nil
+}
+
+type asmError struct {
+	line int
+	text string
+	err  error
+}
+
+func (e *asmError) Error() string {
+	return fmt.Sprintf("line %d: %v: %s", e.line, e.err, e.text)
+}
+
+func assembleFile(fp string) (*Program, error) {
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file: %w", err)
+	}
+
+	return assemble(string(b))
+}
+
+// label values affect encoding sizes, so run passes until labels settle
+func assemble(src string) (*Program, error) {
+	labels := map[string]int{}
+
+	for pass := 0; pass < 16; pass++ {
+		prog, err := assemblePass(src, labels, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if pass > 0 && sameLabels(labels, prog.labels) {
+			return assemblePass(src, labels, true)
+		}
+
+		labels = prog.labels
+	}
+
+	return nil, fmt.Errorf("labels do not converge")
+}
+
+func sameLabels(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// when `final` is false, undefined labels are allowed and treated as zero
+func assemblePass(src string, labels map[string]int, final bool) (*Program, error) {
+	prog := &Program{labels: map[string]int{}}
+	a := &assembler{labels: labels, final: final}
+
+	for idx, text := range strings.Split(src, "\n") {
+		line := text
+
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+
+		line = strings.TrimSpace(line)
+
+		// label, optionally followed by an instruction
+		if i := strings.Index(line, ":"); i >= 0 && isIdentifier(strings.TrimSpace(line[:i])) {
+			name := strings.TrimSpace(line[:i])
+			if _, ok := prog.labels[name]; ok {
+				return nil, &asmError{idx + 1, text, fmt.Errorf("duplicate label %s", name)}
+			}
+			prog.labels[name] = len(prog.code)
+			prog.labelNames = append(prog.labelNames, name)
+			line = strings.TrimSpace(line[i+1:])
+		}
+
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		// directives
+		if strings.ToLower(fields[0]) == "bits" {
+			if len(fields) != 2 || fields[1] != "16" {
+				return nil, &asmError{idx + 1, text, fmt.Errorf("only bits 16 is supported")}
+			}
+			continue
+		}
+
+		// `times 4 db 0`, the count is a constant
+		count := 1
+		if strings.ToLower(fields[0]) == "times" {
+			if len(fields) < 3 {
+				return nil, &asmError{idx + 1, text, fmt.Errorf("times needs a count and an instruction")}
+			}
+
+			n, relative, err := a.eval(fields[1])
+			if err != nil || relative || n < 0 {
+				return nil, &asmError{idx + 1, text, fmt.Errorf("invalid count %s", fields[1])}
+			}
+
+			count = n
+			line = strings.TrimSpace(line[len(fields[0]):])
+			line = strings.TrimSpace(line[len(fields[1]):])
+		}
+
+		a.offset = len(prog.code)
+		code, err := a.assembleLine(line)
+		if err != nil {
+			return nil, &asmError{idx + 1, text, err}
+		}
+		code = bytes.Repeat(code, count)
+
+		op := strings.ToLower(strings.Fields(line)[0])
+		data := op == "db" || op == "dw"
+
+		prog.lines = append(prog.lines, SourceLine{idx + 1, len(prog.code), len(code), strings.TrimSpace(text), data})
+		prog.code = append(prog.code, code...)
+	}
+
+	return prog, nil
+}
+
+type assembler struct {
+	labels map[string]int
+	final  bool
+	// offset of the current instruction, value of `$`
+	offset int
+}
+
+var arithmeticCodes = map[string]byte{
+	"add": 0b000,
+	"sub": 0b101,
+	"cmp": 0b111,
+}
+
+var jumpCodes = map[string]byte{}
+
+var noOperandCodes = map[string]byte{
+	"iret":  0b11001111,
+	"pushf": 0b10011100,
+	"popf":  0b10011101,
+}
+
+func init() {
+	for idx, name := range Jump_Labels {
+		jumpCodes[name] = 0b01110000 | byte(idx)
+	}
+	for idx, name := range Loop_Lables {
+		jumpCodes[name] = 0b11100000 | byte(idx)
+	}
+
+	for code, name := range Control_Names {
+		noOperandCodes[name] = code
+	}
+
+	aliases := map[string]string{
+		"jc": "jb", "jnae": "jb", "jnc": "jnb", "jae": "jnb",
+		"je": "jz", "jne": "jnz", "jna": "jbe", "ja": "jnbe",
+		"jpe": "jp", "jpo": "jnp", "jnge": "jl", "jge": "jnl",
+		"jng": "jle", "jg": "jnle", "loopne": "loopnz", "loope": "loopz",
+	}
+	for alias, name := range aliases {
+		jumpCodes[alias] = jumpCodes[name]
+	}
+}
+
+func (a *assembler) assembleLine(line string) ([]byte, error) {
+	op := line
+	rest := ""
+
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		op = line[:i]
+		rest = strings.TrimSpace(line[i:])
+	}
+
+	op = strings.ToLower(op)
+
+	var operands []Operand
+	if rest != "" {
+		for _, str := range strings.Split(rest, ",") {
+			o, err := a.parseOperand(strings.TrimSpace(str))
+			if err != nil {
+				return nil, err
+			}
+			operands = append(operands, o)
+		}
+	}
+
+	if op == "mov" {
+		return a.encodeMov(operands)
+	}
+
+	if code, ok := arithmeticCodes[op]; ok {
+		return a.encodeArithmetic(code, operands)
+	}
+
+	if code, ok := jumpCodes[op]; ok {
+		return a.encodeJump(code, operands)
+	}
+
+	if op == "int" {
+		return a.encodeInterrupt(operands)
+	}
+
+	if op == "push" || op == "pop" {
+		return a.encodeStack(op == "pop", operands)
+	}
+
+	if op == "in" || op == "out" {
+		return a.encodeInOut(op == "out", operands)
+	}
+
+	if op == "db" || op == "dw" {
+		return a.encodeData(op == "dw", operands)
+	}
+
+	if code, ok := noOperandCodes[op]; ok {
+		if len(operands) != 0 {
+			return nil, fmt.Errorf("%s takes no operands", op)
+		}
+		return []byte{code}, nil
+	}
+
+	return nil, fmt.Errorf("unknown instruction %s", op)
+}
+
+// operand width before it's known from the other operand
+const unknownWide = 0xff
+
+func (a *assembler) parseOperand(str string) (Operand, error) {
+	sized := false
+	wide := byte(unknownWide)
+
+	if f := strings.Fields(str); len(f) > 1 {
+		keyword := strings.ToLower(f[0])
+		rest := strings.TrimSpace(str[len(f[0]):])
+
+		switch keyword {
+		case "byte":
+			sized, wide, str = true, 0, rest
+		case "word":
+			sized, wide, str = true, 1, rest
+		case "short":
+			str = rest
+		}
+	}
+
+	lower := strings.ToLower(str)
+
+	if idx := indexOf(REGISTERS_16, lower); idx >= 0 {
+		return registerOperand(byte(idx), 1), nil
+	}
+	if idx := indexOf(REGISTERS_8, lower); idx >= 0 {
+		return registerOperand(byte(idx), 0), nil
+	}
+	if idx := indexOf(SEGMENT_REGISTERS, lower); idx >= 0 {
+		return segmentOperand(byte(idx)), nil
+	}
+
+	if strings.HasPrefix(str, "[") && strings.HasSuffix(str, "]") {
+		mem, err := a.parseMemory(str[1 : len(str)-1])
+		if err != nil {
+			return Operand{}, err
+		}
+		return Operand{typ: Operand_Memory, wide: wide, mem: mem, sized: sized}, nil
+	}
+
+	value, relative, err := a.eval(str)
+	if err != nil {
+		return Operand{}, err
+	}
+
+	if relative {
+		return relativeOperand(value - a.offset), nil
+	}
+
+	return Operand{typ: Operand_Immediate, wide: wide, imm: uint16(value), sized: sized}, nil
+}
+
+// e.g. `bp + si - 4`, `1000`
+func (a *assembler) parseMemory(str string) (Common, error) {
+	var regs []string
+	var rest []string
+
+	for _, term := range splitTerms(str) {
+		name := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(term, "+")))
+		if name == "bx" || name == "bp" || name == "si" || name == "di" {
+			regs = append(regs, name)
+			continue
+		}
+		rest = append(rest, term)
+	}
+
+	disp := 0
+	if len(rest) > 0 {
+		value, relative, err := a.eval(strings.Join(rest, ""))
+		if err != nil {
+			return Common{}, err
+		}
+		if relative {
+			return Common{}, fmt.Errorf("`$` is not supported in memory operands")
+		}
+		disp = value
+	}
+
+	// direct address
+	if len(regs) == 0 {
+		return Common{mod: 0b00, rm: 0b110, disp: int16(disp)}, nil
+	}
+
+	sort.Strings(regs)
+	rm := -1
+
+	switch strings.Join(regs, "+") {
+	case "bx+si":
+		rm = 0b000
+	case "bx+di":
+		rm = 0b001
+	case "bp+si":
+		rm = 0b010
+	case "bp+di":
+		rm = 0b011
+	case "si":
+		rm = 0b100
+	case "di":
+		rm = 0b101
+	case "bp":
+		rm = 0b110
+	case "bx":
+		rm = 0b111
+	}
+
+	if rm < 0 {
+		return Common{}, fmt.Errorf("invalid effective address [%s]", str)
+	}
+
+	result := Common{rm: byte(rm), disp: int16(disp)}
+
+	switch true {
+	// [bp] has no mod=00 form, that's the direct address
+	case disp == 0 && rm != 0b110:
+		result.mod = 0b00
+	case fitsInt8(disp):
+		result.mod = 0b01
+	default:
+		result.mod = 0b10
+	}
+
+	return result, nil
+}
+
+// split an expression into signed terms, e.g. `bx+si-4` -> `bx`, `+si`, `-4`
+func splitTerms(str string) []string {
+	var result []string
+	start := 0
+
+	for i := 1; i < len(str); i++ {
+		if str[i] == '+' || str[i] == '-' {
+			result = append(result, strings.TrimSpace(str[start:i]))
+			start = i
+		}
+	}
+
+	return append(result, strings.TrimSpace(str[start:]))
+}
+
+// evaluate `+`/`-` expression of numbers, labels and `$`,
+// `relative` is true when it's relative to `$`
+func (a *assembler) eval(str string) (int, bool, error) {
+	result := 0
+	relative := false
+
+	for _, term := range splitTerms(str) {
+		sign := 1
+		if strings.HasPrefix(term, "-") {
+			sign = -1
+		}
+
+		term = strings.TrimSpace(strings.TrimLeft(term, "+-"))
+
+		if term == "$" {
+			if sign < 0 || relative {
+				return 0, false, fmt.Errorf("invalid expression %s", str)
+			}
+			relative = true
+			result += a.offset
+			continue
+		}
+
+		if value, err := parseNumber(term); err == nil {
+			result += sign * value
+			continue
+		}
+
+		if isIdentifier(term) {
+			value, ok := a.labels[term]
+			if !ok && a.final {
+				return 0, false, fmt.Errorf("undefined label %s", term)
+			}
+			result += sign * value
+			continue
+		}
+
+		return 0, false, fmt.Errorf("invalid expression %s", str)
+	}
+
+	return result, relative, nil
+}
+
+func parseNumber(str string) (int, error) {
+	lower := strings.ToLower(str)
+
+	if len(str) == 3 && (str[0] == '\'' || str[0] == '"') && str[2] == str[0] {
+		return int(str[1]), nil
+	}
+
+	var value int64
+	var err error
+
+	switch true {
+	case strings.HasPrefix(lower, "0x"):
+		value, err = strconv.ParseInt(lower[2:], 16, 32)
+	case strings.HasPrefix(lower, "0b"):
+		value, err = strconv.ParseInt(lower[2:], 2, 32)
+	case strings.HasSuffix(lower, "h") && len(lower) > 1 && lower[0] >= '0' && lower[0] <= '9':
+		value, err = strconv.ParseInt(lower[:len(lower)-1], 16, 32)
+	default:
+		value, err = strconv.ParseInt(lower, 10, 32)
+	}
+
+	return int(value), err
+}
+
+func isIdentifier(str string) bool {
+	if str == "" {
+		return false
+	}
+
+	for idx, c := range str {
+		letter := c == '_' || c == '.' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		digit := c >= '0' && c <= '9'
+
+		if !letter && !(digit && idx > 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func indexOf(names []string, name string) int {
+	for idx, n := range names {
+		if n == name {
+			return idx
+		}
+	}
+	return -1
+}
+
+func fitsInt8(v int) bool {
+	return v >= -128 && v <= 127
+}
+
+// immediate of a word instruction fits a sign extended byte
+func fitsSignExtended(imm uint16) bool {
+	return fitsInt8(int(int16(imm)))
+}
+
+// resolve the width of a two operands instruction
+func resolveWide(dst, src *Operand) (byte, error) {
+	switch true {
+	case dst.wide != unknownWide && src.wide != unknownWide:
+		if dst.wide != src.wide {
+			return 0, fmt.Errorf("mismatch in operand sizes")
+		}
+		return dst.wide, nil
+	case dst.wide != unknownWide:
+		return dst.wide, nil
+	case src.wide != unknownWide:
+		return src.wide, nil
+	}
+
+	return 0, fmt.Errorf("operation size not specified")
+}
+
+func encodeModRM(mod, reg, rm byte) byte {
+	return (mod << 6) | (reg << 3) | rm
+}
+
+// mod reg r/m byte and the displacement
+func encodeRM(reg byte, o *Operand) []byte {
+	if o.typ == Operand_Register {
+		return []byte{encodeModRM(0b11, reg, o.reg)}
+	}
+
+	c := o.mem
+	result := []byte{encodeModRM(c.mod, reg, c.rm)}
+
+	switch true {
+	case c.mod == 0b01:
+		result = append(result, byte(c.disp))
+	case c.mod == 0b10 || (c.mod == 0b00 && c.rm == 0b110):
+		result = append(result, byte(c.disp), byte(uint16(c.disp)>>8))
+	}
+
+	return result
+}
+
+func encodeImmediate(imm uint16, wide byte) []byte {
+	if wide == 1 {
+		return []byte{byte(imm), byte(imm >> 8)}
+	}
+	return []byte{byte(imm)}
+}
+
+func checkImmediate(o *Operand, wide byte) error {
+	v := int(int16(o.imm))
+	if wide == 0 && (v < -128 || v > 255) {
+		return fmt.Errorf("byte immediate out of range: %d", v)
+	}
+	return nil
+}
+
+func (a *assembler) encodeMov(operands []Operand) ([]byte, error) {
+	if len(operands) != 2 {
+		return nil, fmt.Errorf("mov needs two operands")
+	}
+
+	dst, src := &operands[0], &operands[1]
+
+	w, err := resolveWide(dst, src)
+	if err != nil {
+		return nil, err
+	}
+
+	switch true {
+	case dst.typ == Operand_SegmentRegister && (src.typ == Operand_Register || src.typ == Operand_Memory):
+		{
+			result := []byte{0b10001110}
+			return append(result, encodeRM(dst.reg, src)...), nil
+		}
+	case src.typ == Operand_SegmentRegister && (dst.typ == Operand_Register || dst.typ == Operand_Memory):
+		{
+			result := []byte{0b10001100}
+			return append(result, encodeRM(src.reg, dst)...), nil
+		}
+	case dst.typ == Operand_Register && src.typ == Operand_Immediate:
+		{
+			if err := checkImmediate(src, w); err != nil {
+				return nil, err
+			}
+			result := []byte{0b10110000 | (w << 3) | dst.reg}
+			return append(result, encodeImmediate(src.imm, w)...), nil
+		}
+	case dst.typ == Operand_Register && dst.reg == 0 && src.isDirect():
+		{
+			return []byte{0b10100000 | w, byte(src.mem.disp), byte(uint16(src.mem.disp) >> 8)}, nil
+		}
+	case dst.isDirect() && src.typ == Operand_Register && src.reg == 0:
+		{
+			return []byte{0b10100010 | w, byte(dst.mem.disp), byte(uint16(dst.mem.disp) >> 8)}, nil
+		}
+	case src.typ == Operand_Register && (dst.typ == Operand_Register || dst.typ == Operand_Memory):
+		{
+			result := []byte{0b10001000 | w}
+			return append(result, encodeRM(src.reg, dst)...), nil
+		}
+	case dst.typ == Operand_Register && src.typ == Operand_Memory:
+		{
+			result := []byte{0b10001010 | w}
+			return append(result, encodeRM(dst.reg, src)...), nil
+		}
+	case dst.typ == Operand_Memory && src.typ == Operand_Immediate:
+		{
+			if err := checkImmediate(src, w); err != nil {
+				return nil, err
+			}
+			result := []byte{0b11000110 | w}
+			result = append(result, encodeRM(0, dst)...)
+			return append(result, encodeImmediate(src.imm, w)...), nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid combination of operands")
+}
+
+func (a *assembler) encodeArithmetic(code byte, operands []Operand) ([]byte, error) {
+	if len(operands) != 2 {
+		return nil, fmt.Errorf("arithmetic needs two operands")
+	}
+
+	dst, src := &operands[0], &operands[1]
+
+	w, err := resolveWide(dst, src)
+	if err != nil {
+		return nil, err
+	}
+
+	switch true {
+	case src.typ == Operand_Register && (dst.typ == Operand_Register || dst.typ == Operand_Memory):
+		{
+			result := []byte{(code << 3) | w}
+			return append(result, encodeRM(src.reg, dst)...), nil
+		}
+	case dst.typ == Operand_Register && src.typ == Operand_Memory:
+		{
+			result := []byte{(code << 3) | 0b10 | w}
+			return append(result, encodeRM(dst.reg, src)...), nil
+		}
+	case src.typ == Operand_Immediate && (dst.typ == Operand_Register || dst.typ == Operand_Memory):
+		{
+			if err := checkImmediate(src, w); err != nil {
+				return nil, err
+			}
+
+			// sign extended byte
+			if w == 1 && fitsSignExtended(src.imm) {
+				result := []byte{0b10000011}
+				result = append(result, encodeRM(code, dst)...)
+				return append(result, byte(src.imm)), nil
+			}
+
+			// accumulator
+			if dst.typ == Operand_Register && dst.reg == 0 {
+				result := []byte{(code << 3) | 0b100 | w}
+				return append(result, encodeImmediate(src.imm, w)...), nil
+			}
+
+			result := []byte{0b10000000 | w}
+			result = append(result, encodeRM(code, dst)...)
+			return append(result, encodeImmediate(src.imm, w)...), nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid combination of operands")
+}
+
+func (a *assembler) encodeJump(code byte, operands []Operand) ([]byte, error) {
+	if len(operands) != 1 {
+		return nil, fmt.Errorf("jump needs one operand")
+	}
+
+	o := &operands[0]
+
+	var rel int
+	switch o.typ {
+	case Operand_Relative:
+		rel = o.rel
+	case Operand_Immediate:
+		// label, absolute offset
+		rel = int(o.imm) - a.offset
+	default:
+		return nil, fmt.Errorf("invalid jump target")
+	}
+
+	// relative to the next instruction
+	inc := rel - 2
+
+	if !fitsInt8(inc) {
+		if a.final {
+			return nil, fmt.Errorf("short jump is out of range")
+		}
+		inc = 0
+	}
+
+	return []byte{code, byte(int8(inc))}, nil
+}
+
+func (a *assembler) encodeInterrupt(operands []Operand) ([]byte, error) {
+	if len(operands) != 1 || operands[0].typ != Operand_Immediate {
+		return nil, fmt.Errorf("int needs an immediate operand")
+	}
+
+	if operands[0].imm > 0xff {
+		return nil, fmt.Errorf("interrupt vector out of range: %d", operands[0].imm)
+	}
+
+	return []byte{0b11001101, byte(operands[0].imm)}, nil
+}
+
+func (a *assembler) encodeStack(pop bool, operands []Operand) ([]byte, error) {
+	if len(operands) != 1 {
+		return nil, fmt.Errorf("push and pop need one operand")
+	}
+
+	o := &operands[0]
+
+	switch true {
+	case o.typ == Operand_Register && o.wide == 1:
+		{
+			if pop {
+				return []byte{0b01011000 | o.reg}, nil
+			}
+			return []byte{0b01010000 | o.reg}, nil
+		}
+	case o.typ == Operand_SegmentRegister:
+		{
+			if pop && o.reg == 1 {
+				return nil, fmt.Errorf("cs can not be popped")
+			}
+			if pop {
+				return []byte{0b00000111 | o.reg<<3}, nil
+			}
+			return []byte{0b00000110 | o.reg<<3}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("push and pop need a word register or segment register")
+}
+
+// `in al, 0x40`, `out dx, ax`
+func (a *assembler) encodeInOut(out bool, operands []Operand) ([]byte, error) {
+	if len(operands) != 2 {
+		return nil, fmt.Errorf("in and out need two operands")
+	}
+
+	acc, port := &operands[0], &operands[1]
+	if out {
+		acc, port = port, acc
+	}
+
+	if acc.typ != Operand_Register || acc.reg != 0 {
+		return nil, fmt.Errorf("in and out need al or ax")
+	}
+
+	code := 0b11100100 | acc.wide
+	if out {
+		code |= 0b10
+	}
+
+	switch true {
+	case port.typ == Operand_Register && port.reg == 2 && port.wide == 1:
+		return []byte{code | 0b1000}, nil
+	case port.typ == Operand_Immediate:
+		{
+			if port.imm > 0xff {
+				return nil, fmt.Errorf("port out of range: %d, use dx", port.imm)
+			}
+			return []byte{code, byte(port.imm)}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("the port is an immediate or dx")
+}
+
+// `db 1, 'A'`, `dw label`
+func (a *assembler) encodeData(word bool, operands []Operand) ([]byte, error) {
+	if len(operands) == 0 {
+		return nil, fmt.Errorf("data needs at least one value")
+	}
+
+	var wide byte
+	if word {
+		wide = 1
+	}
+
+	var result []byte
+	for idx := range operands {
+		o := &operands[idx]
+
+		if o.typ != Operand_Immediate {
+			return nil, fmt.Errorf("data must be numbers or labels")
+		}
+
+		if err := checkImmediate(o, wide); err != nil {
+			return nil, err
+		}
+
+		result = append(result, encodeImmediate(o.imm, wide)...)
+	}
+
+	return result, nil
+}
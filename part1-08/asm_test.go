@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// listings with instructions the decoder doesn't support yet
+var roundTripSkip = map[string]bool{
+	"listing_0042_completionist_decode.asm": true,
+}
+
+// bytes of the listings from an assembler other than ours, GNU as in
+// 16-bit intel syntax, which picks the same encodings as nasm for them
+var listingBytes = map[string]string{
+	"listing_0037_single_register_mov": "89d9",
+	"listing_0038_many_register_mov":   "89d988e589da89de89fb88c888ed89c389f389fc89c5",
+	"listing_0039_more_movs": "" +
+		"89de88c6b10cb5f4b90c00b9f4ffba6c0fba94f08a008b1b8b56008a60048a80" +
+		"87138909880a886e00",
+	"listing_0040_challenge_movs": "" +
+		"8b41db898cd4fe8b57e0c60307c78585035b018b2e05008b1e820da1fb09a110" +
+		"00a3fa09a30f00",
+	"listing_0041_add_sub_cmp_jnz": "" +
+		"0318035e0083c60283c50283c108035e00034f02027a04037b060118015e0001" +
+		"5e00014f02007a04017b068007228382e8031d034600020001d800e005e80304" +
+		"e204092b182b5e0083ee0283ed0283e9082b5e002b4f022a7a042b7b06291829" +
+		"5e00295e00294f02287a04297b06802f2283291d2b46002a0029d828e02de803" +
+		"2ce22c093b183b5e0083fe0283fd0283f9083b5e003b4f023a7a043b7b063918" +
+		"395e00395e00394f02387a04397b06803f22833ee2121d3b46003a0039d838e0" +
+		"3de8033ce23c09750275fc75fa75fc74fe7cfc7efa72f876f67af470f278f075" +
+		"ee7dec7fea73e877e67be471e279e0e2dee1dce0dae3d8",
+	"listing_0043_immediate_movs": "b80100bb0200b90300ba0400bc0500bd0600be0700bf0800",
+	"listing_0044_register_movs":  "b80100bb0200b90300ba040089c489dd89ce89d789e289e989f389f8",
+	"listing_0045_challenge_register_movs": "" +
+		"b82222bb4444b96666ba88888ed08edb8ec1b011b733b155b67788dc88f18ed0" +
+		"8edb8ec18cd48cdd8cc689d7",
+	"listing_0046_add_sub_cmp":       "bb03f0b9010f29cbbce603bde70339e581c5030481edea07",
+	"listing_0048_ip_register":       "b9c80089cb81c1e803bbd00729d9",
+	"listing_0049_conditional_jumps": "b90300bbe80383c30a83e90175f8",
+}
+
+// checked in bytes of the listing
+func expectedBytes(t *testing.T, file string) []byte {
+	t.Helper()
+
+	str, ok := listingBytes[strings.TrimSuffix(filepath.Base(file), ".asm")]
+	if !ok {
+		t.Fatalf("no expected bytes for %s", file)
+	}
+
+	expected, err := hex.DecodeString(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expected
+}
+
+func listingFiles(t *testing.T) []string {
+	t.Helper()
+
+	var files []string
+	for _, pattern := range []string{"../part1-01/*.asm", "../part1-03/listing/*.asm", "../part1-06/listing/*.asm", "../part1-07/listing/*.asm", "listing/*.asm"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, matches...)
+	}
+
+	if len(files) == 0 {
+		t.Fatal("no listings")
+	}
+	return files
+}
+
+func TestAssembleListings(t *testing.T) {
+	for _, file := range listingFiles(t) {
+		t.Run(file, func(t *testing.T) {
+			if roundTripSkip[filepath.Base(file)] {
+				t.Skip("unsupported instructions")
+			}
+
+			prog, err := assembleFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := expectedBytes(t, file); !bytes.Equal(prog.code, expected) {
+				t.Errorf("bytes differ\n got:  % X\n want: % X", prog.code, expected)
+			}
+		})
+	}
+}
+
+// disassemble the bytes of every listing, assemble the result and compare
+func TestRoundTripListings(t *testing.T) {
+	for _, file := range listingFiles(t) {
+		t.Run(file, func(t *testing.T) {
+			if roundTripSkip[filepath.Base(file)] {
+				t.Skip("unsupported instructions")
+			}
+
+			expected := expectedBytes(t, file)
+
+			lines := []string{"bits 16"}
+			r := newReader(expected)
+			for !r.isEmpty() {
+				cmd, err := decodeCommand(r)
+				if err != nil {
+					t.Fatalf("decode at 0x%x: %v", r.idx, err)
+				}
+				lines = append(lines, cmd.Disassemble())
+			}
+
+			again, err := assemble(strings.Join(lines, "\n"))
+			if err != nil {
+				t.Fatalf("assemble the disassembly: %v", err)
+			}
+
+			if !bytes.Equal(again.code, expected) {
+				t.Errorf("reassembled bytes differ\n got:  % X\n want: % X", again.code, expected)
+			}
+		})
+	}
+}
+
+// the builtin assembler against nasm, if it's installed
+func TestAssembleLikeNASM(t *testing.T) {
+	if _, err := exec.LookPath("nasm"); err != nil {
+		t.Skip("nasm is not installed")
+	}
+
+	for _, file := range listingFiles(t) {
+		t.Run(file, func(t *testing.T) {
+			if roundTripSkip[filepath.Base(file)] {
+				t.Skip("unsupported instructions")
+			}
+
+			prog, err := assembleFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out := filepath.Join(t.TempDir(), "out")
+			if err := exec.Command("nasm", "-o", out, file).Run(); err != nil {
+				t.Fatalf("nasm: %v", err)
+			}
+
+			expected, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(prog.code, expected) {
+				t.Errorf("bytes differ from nasm\n got:  % X\n want: % X", prog.code, expected)
+			}
+		})
+	}
+}
+
+// interrupt, stack, port and control instructions, the bytes are from
+// GNU as like listingBytes
+func TestSystemInstructions(t *testing.T) {
+	tests := []struct {
+		text  string
+		bytes string
+	}{
+		{"int 16", "cd10"},
+		{"int 3", "cd03"},
+		{"iret", "cf"},
+		{"push ax", "50"},
+		{"push di", "57"},
+		{"push ds", "1e"},
+		{"push es", "06"},
+		{"pop bx", "5b"},
+		{"pop si", "5e"},
+		{"pop ss", "17"},
+		{"pop es", "07"},
+		{"in al, 96", "e460"},
+		{"in ax, 64", "e540"},
+		{"in al, dx", "ec"},
+		{"in ax, dx", "ed"},
+		{"out 67, al", "e643"},
+		{"out 64, ax", "e740"},
+		{"out dx, al", "ee"},
+		{"out dx, ax", "ef"},
+		{"cli", "fa"},
+		{"sti", "fb"},
+		{"hlt", "f4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			expected, err := hex.DecodeString(tt.bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			prog := assembleSource(t, "bits 16\n"+tt.text)
+			if !bytes.Equal(prog.code, expected) {
+				t.Errorf("assembled to % X, want % X", prog.code, expected)
+			}
+
+			r := newReader(expected)
+			cmd, err := decodeCommand(r)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if got := cmd.Disassemble(); got != tt.text || r.idx != len(expected) {
+				t.Errorf("decoded %d bytes to %s", r.idx, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// simulation speed on a tight loop
+//
+// The same program runs decoding every step, with the decode cache, with
+// the cache but without tracing, and on the block engine, the final
+// registers must match.
+
+// inner loop iterations per outer iteration
+const benchInner = 1000
+
+// two nested countdown loops, about n instructions in total
+func benchProgram(n int) string {
+	outer := max(1, n/(benchInner*3))
+
+	return fmt.Sprintf(`bits 16
+mov dx, %d
+outer:
+mov cx, %d
+inner:
+add ax, cx
+sub cx, 1
+jnz inner
+sub dx, 1
+jnz outer
+`, outer, benchInner)
+}
+
+type benchConfig struct {
+	name   string
+	cached bool
+	trace  bool
+	blocks bool
+}
+
+var benchConfigs = []benchConfig{
+	{"decode every step", false, true, false},
+	{"decode cache", true, true, false},
+	{"decode cache, no trace", true, false, false},
+	{"blocks", true, false, true},
+}
+
+type benchResult struct {
+	count   int
+	elapsed time.Duration
+	allocs  uint64
+	regs    [8]uint16
+}
+
+func (b *benchResult) perSecond() float64 {
+	return float64(b.count) / b.elapsed.Seconds()
+}
+
+func benchRun(code []byte, conf benchConfig) (*benchResult, error) {
+	sim := newSim(code)
+	sim.trace = conf.trace
+	if !conf.cached {
+		sim.decodeCache = nil
+	}
+
+	result := &benchResult{}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	if conf.blocks {
+		sim.blocks = newBlockEngine()
+		err := sim.blocks.run(sim, func(d *Delta) error {
+			result.count += 1
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for !conf.blocks {
+		cmd, _, err := sim.step()
+		if err != nil {
+			return nil, err
+		}
+		if cmd == nil {
+			break
+		}
+		result.count += 1
+	}
+
+	result.elapsed = time.Since(start)
+	runtime.ReadMemStats(&after)
+	result.allocs = after.Mallocs - before.Mallocs
+	result.regs = sim.regs
+
+	return result, nil
+}
+
+// return false if the runs disagree
+func runBench(n int) bool {
+	prog, err := assemble(benchProgram(n))
+	if err != nil {
+		fmt.Printf("assemble error: %v\n", err)
+		return false
+	}
+
+	var first *benchResult
+
+	for _, conf := range benchConfigs {
+		result, err := benchRun(prog.code, conf)
+		if err != nil {
+			fmt.Printf("%s: %v\n", conf.name, err)
+			return false
+		}
+
+		fmt.Printf("%-24s %d instructions in %v, %.0f instructions/s, %.2f allocs/instruction",
+			conf.name+":", result.count, result.elapsed, result.perSecond(), float64(result.allocs)/float64(result.count))
+
+		if first == nil {
+			first = result
+			fmt.Println()
+			continue
+		}
+
+		fmt.Printf(", %.2fx\n", result.perSecond()/first.perSecond())
+
+		if result.count != first.count || result.regs != first.regs {
+			fmt.Println("FAIL the runs end in different states")
+			return false
+		}
+	}
+
+	return true
+}
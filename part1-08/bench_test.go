@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// never ends, every iteration reads and writes memory
+const benchLoop = `bits 16
+mov bx, 1000
+top:
+add ax, 1
+add [bx], ax
+mov cx, [bx]
+cmp ax, ax
+jz top
+`
+
+func benchSim(tb testing.TB, trace bool) *Sim {
+	prog, err := assemble(benchLoop)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	s := newSim(prog.code)
+	s.trace = trace
+	return s
+}
+
+func benchSteps(b *testing.B, s *Sim) {
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := s.step(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "instructions/s")
+}
+
+func BenchmarkStep(b *testing.B) {
+	benchSteps(b, benchSim(b, true))
+}
+
+func BenchmarkStepNoTrace(b *testing.B) {
+	benchSteps(b, benchSim(b, false))
+}
+
+func BenchmarkStepNoCache(b *testing.B) {
+	s := benchSim(b, false)
+	s.decodeCache = nil
+	benchSteps(b, s)
+}
+
+func BenchmarkBlocks(b *testing.B) {
+	s := benchSim(b, false)
+	s.blocks = newBlockEngine()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	done := errors.New("done")
+	count := 0
+	err := s.blocks.run(s, func(d *Delta) error {
+		count += 1
+		if count == b.N {
+			return done
+		}
+		return nil
+	})
+	if err != done {
+		b.Fatal(err)
+	}
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "instructions/s")
+}
+
+// without tracing a step doesn't allocate once the decode cache is warm
+func TestStepAllocations(t *testing.T) {
+	s := benchSim(t, false)
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		if _, _, err := s.step(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if allocs != 0 {
+		t.Errorf("%v allocations per step, want 0", allocs)
+	}
+}
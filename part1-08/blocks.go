@@ -0,0 +1,305 @@
+package main
+
+// basic block execution engine
+//
+// A block is the run of instructions from an address up to and including
+// the next jump, loop, interrupt or hlt. It is translated once into a
+// chain of handlers bound to each instruction's form, so executing it
+// skips decoding and dispatch. Clocks, interrupts and the rest of the
+// per instruction bookkeeping are the interpreter's, see retireIns, so
+// both produce the same machine state.
+//
+// The block is left early when ip goes somewhere else, e.g. a hardware
+// interrupt. Writing to the bytes of a translated block drops it and the
+// address is run by the step interpreter from then on.
+
+// instructions per block at most
+const maxBlockLen = 64
+
+type blockOp struct {
+	ins Ins
+	// executes the instruction and advances ip
+	run func(s *Sim, ins *Ins) error
+}
+
+type block struct {
+	start, end int
+	ops        []blockOp
+	// its code was written, see invalidate
+	stale bool
+}
+
+type BlockEngine struct {
+	// by start address
+	blocks []*block
+	// bytes of translated blocks
+	code []bool
+	// block starts with self-modifying code
+	interpreted []bool
+
+	translated int
+	executed   int
+	// instructions run by the interpreter
+	fallbacks int
+}
+
+func newBlockEngine() *BlockEngine {
+	return &BlockEngine{}
+}
+
+// drop everything, the program may have a different size now
+func (e *BlockEngine) reset() {
+	e.blocks = nil
+	e.code = nil
+	e.interpreted = nil
+}
+
+// the block at addr, nil if the interpreter has to run it
+func (e *BlockEngine) block(s *Sim, addr int) (*block, error) {
+	if len(e.blocks) != s.initSize {
+		e.blocks = make([]*block, s.initSize)
+		e.code = make([]bool, s.initSize)
+		e.interpreted = make([]bool, s.initSize)
+	}
+
+	if e.interpreted[addr] {
+		return nil, nil
+	}
+
+	if b := e.blocks[addr]; b != nil {
+		return b, nil
+	}
+
+	b, err := e.translate(s, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	e.blocks[addr] = b
+	for a := b.start; a < min(b.end, len(e.code)); a++ {
+		e.code[a] = true
+	}
+	e.translated += 1
+
+	return b, nil
+}
+
+func (e *BlockEngine) translate(s *Sim, start int) (*block, error) {
+	b := &block{start: start, end: start}
+
+	for b.end < s.initSize && len(b.ops) < maxBlockLen {
+		r := newReader(s.mem[b.end:])
+		cmd, err := decodeCommand(r)
+		if err != nil {
+			// reported when execution gets there
+			if len(b.ops) > 0 {
+				break
+			}
+			return nil, err
+		}
+
+		ins := flatten(cmd, r.idx)
+		b.ops = append(b.ops, blockOp{ins, bindIns(&ins)})
+		b.end += r.idx
+
+		if ins.kind == Ins_JumpOrLoop || ins.kind == Ins_Interrupt || ins.isHalt() {
+			break
+		}
+	}
+
+	return b, nil
+}
+
+// drop the blocks covering addr, they are interpreted from now on
+func (e *BlockEngine) invalidate(addr int) {
+	if addr >= len(e.code) || !e.code[addr] {
+		return
+	}
+
+	for start := max(0, addr-maxBlockLen*maxInsSize+1); start <= addr; start++ {
+		b := e.blocks[start]
+		if b != nil && b.end > addr {
+			b.stale = true
+			e.blocks[start] = nil
+			e.interpreted[start] = true
+		}
+	}
+}
+
+// run until the end of the program, `after` is called with the delta of
+// every instruction and stops the run with its error
+func (e *BlockEngine) run(s *Sim, after func(d *Delta) error) error {
+	// one for the whole run, it escapes to `after`
+	var d Delta
+
+	for s.ip < s.initSize {
+		b, err := e.block(s, s.ip)
+		if err != nil {
+			return err
+		}
+
+		if b == nil {
+			ins, err := s.decode()
+			if err != nil {
+				return err
+			}
+
+			d, err = s.execIns(ins)
+			if err != nil {
+				return err
+			}
+
+			e.fallbacks += 1
+			if err := after(&d); err != nil {
+				return err
+			}
+			continue
+		}
+
+		e.executed += 1
+
+		for idx := range b.ops {
+			op := &b.ops[idx]
+			s.lastInsSize = op.ins.size
+
+			old := s.beginIns()
+			if err := op.run(s, &op.ins); err != nil {
+				return err
+			}
+
+			d, err = s.retireIns(&op.ins, &old)
+			if err != nil {
+				return err
+			}
+
+			if err := after(&d); err != nil {
+				return err
+			}
+
+			if b.stale || s.ip != old.ip+op.ins.size {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// handler of the instruction's form, common forms get their own
+func bindIns(ins *Ins) func(s *Sim, ins *Ins) error {
+	switch ins.kind {
+	case Ins_Mov:
+		if ins.movTyp == Mov_Immediate_To_Register {
+			return runMovImmediate
+		}
+		return runMov
+	case Ins_Arithmetic:
+		if ins.mod == 0b11 && ins.arithTyp != Arithmetic_Immediate_To_Accumulator {
+			return runArithmeticRegister
+		}
+		return runArithmetic
+	case Ins_JumpOrLoop:
+		switch ins.op {
+		case 0b01110100:
+			return runJz
+		case 0b01110101:
+			return runJnz
+		}
+		return runJumpOrLoop
+	case Ins_Interrupt:
+		return runInterrupt
+	case Ins_Stack:
+		return runStack
+	case Ins_InOut:
+		return runInOut
+	}
+
+	return runControl
+}
+
+func runMovImmediate(s *Sim, ins *Ins) error {
+	s.setReg(ins.reg, ins.data, ins.w)
+	s.ip += ins.size
+	return nil
+}
+
+func runMov(s *Sim, ins *Ins) error {
+	err := s.handleMov(ins)
+	s.ip += ins.size
+	return err
+}
+
+// register to register or immediate to register, no memory access
+func runArithmeticRegister(s *Sim, ins *Ins) error {
+	dst, src := ins.rm, ins.reg
+	source := ins.data
+
+	if ins.arithTyp == Arithmetic_RegOrMemory_With_Register_To_Either {
+		if ins.d == 1 {
+			dst, src = src, dst
+		}
+		source = s.getReg(src, ins.w)
+	}
+
+	target := s.getReg(dst, ins.w)
+
+	result := s.arith(ins.arithOp, target, source, ins.w)
+	if ins.arithOp != Arithmetic_Cmp {
+		s.setReg(dst, result, ins.w)
+	}
+
+	s.ip += ins.size
+	return nil
+}
+
+func runArithmetic(s *Sim, ins *Ins) error {
+	s.handleArithmetic(ins)
+	s.ip += ins.size
+	return nil
+}
+
+func runJz(s *Sim, ins *Ins) error {
+	s.ip += ins.size
+	s.branchTaken = s.flags.zero
+	if s.branchTaken {
+		s.ip += int(ins.inc)
+	}
+	return nil
+}
+
+func runJnz(s *Sim, ins *Ins) error {
+	s.ip += ins.size
+	s.branchTaken = !s.flags.zero
+	if s.branchTaken {
+		s.ip += int(ins.inc)
+	}
+	return nil
+}
+
+func runJumpOrLoop(s *Sim, ins *Ins) error {
+	s.ip += ins.size
+	return s.handleJumpOrLoop(ins)
+}
+
+func runInterrupt(s *Sim, ins *Ins) error {
+	s.ip += ins.size
+	return s.handleInterrupt(ins)
+}
+
+func runStack(s *Sim, ins *Ins) error {
+	s.handleStack(ins)
+	s.ip += ins.size
+	return nil
+}
+
+func runInOut(s *Sim, ins *Ins) error {
+	err := s.handleInOut(ins)
+	s.ip += ins.size
+	return err
+}
+
+func runControl(s *Sim, ins *Ins) error {
+	err := s.handleControl(ins)
+	s.ip += ins.size
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// timer channel 0 as a rate generator, the emulated BIOS handles IRQ0
+// while the loop runs
+const timerLoop = `bits 16
+mov al, 0x34
+out 0x43, al
+mov al, 100
+out 0x40, al
+mov al, 0
+out 0x40, al
+sti
+mov cx, 2000
+top:
+add ax, cx
+add [1000], ax
+sub cx, 1
+jnz top
+`
+
+type engineProgram struct {
+	name string
+	code []byte
+}
+
+func engineProgramsForTest(t *testing.T) []engineProgram {
+	t.Helper()
+
+	var programs []engineProgram
+	for _, file := range listingFiles(t) {
+		if roundTripSkip[filepath.Base(file)] {
+			continue
+		}
+
+		prog, err := assembleFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		programs = append(programs, engineProgram{file, prog.code})
+	}
+
+	for _, p := range []struct{ name, src string }{
+		{"self-modifying", selfModifying},
+		{"timer", timerLoop},
+		{"bench", benchProgram(10000)},
+	} {
+		programs = append(programs, engineProgram{p.name, assembleSource(t, p.src).code})
+	}
+
+	return programs
+}
+
+// same instructions, clocks, interrupts and final state on both engines
+func TestBlocksMatchStep(t *testing.T) {
+	for _, p := range engineProgramsForTest(t) {
+		for _, is8088 := range []bool{false, true} {
+			name := p.name + "/8086"
+			if is8088 {
+				name = p.name + "/8088"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				setup := func() *Sim {
+					s := newSim(p.code)
+					s.is8088 = is8088
+					s.prefetch = newPrefetcher(is8088)
+					return s
+				}
+
+				step := runStepEngine(setup(), newLimiter(100000, 0))
+				blocks := runBlockEngine(setup(), newLimiter(100000, 0))
+
+				if step.count == 0 {
+					t.Fatalf("nothing executed: %s", step.err)
+				}
+				if *step != *blocks {
+					t.Errorf("\nstep:   %s\nblocks: %s", step, blocks)
+				}
+			})
+		}
+	}
+}
+
+// the timer program has to actually be interrupted to test anything
+func TestTimerLoopInterrupts(t *testing.T) {
+	irqs := 0
+	for _, d := range runSim(t, newSim(assembleSource(t, timerLoop).code)) {
+		if d.irq {
+			irqs += 1
+		}
+	}
+
+	if irqs == 0 {
+		t.Error("no timer interrupts")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// code coverage: executed instruction bytes and branch directions
+//
+// The text report marks instructions that never ran with `#####` like
+// gcov and shows how often each conditional branch went each way. The
+// lcov tracefile is keyed by lines of the .asm source, so a binary
+// without source only gets the text report. `db` and `dw` lines are not
+// counted.
+
+type branchCoverage struct {
+	taken    int
+	notTaken int
+}
+
+func (b *branchCoverage) String() string {
+	switch true {
+	case b.taken == 0:
+		return fmt.Sprintf("never taken, not taken %d", b.notTaken)
+	case b.notTaken == 0:
+		return fmt.Sprintf("always taken, taken %d", b.taken)
+	}
+
+	return fmt.Sprintf("taken %d, not taken %d", b.taken, b.notTaken)
+}
+
+type Coverage struct {
+	// executions and size of the instruction starting at an address
+	hits  map[int]int
+	sizes map[int]int
+	// conditional jumps and loops by address
+	branches map[int]*branchCoverage
+}
+
+func newCoverage() *Coverage {
+	return &Coverage{hits: map[int]int{}, sizes: map[int]int{}, branches: map[int]*branchCoverage{}}
+}
+
+func (c *Coverage) record(addr int, size int, branch bool, taken bool) {
+	c.hits[addr] += 1
+	c.sizes[addr] = size
+
+	if !branch {
+		return
+	}
+
+	b := c.branches[addr]
+	if b == nil {
+		b = &branchCoverage{}
+		c.branches[addr] = b
+	}
+
+	if taken {
+		b.taken += 1
+	} else {
+		b.notTaken += 1
+	}
+}
+
+// a source line, or an instruction of the linear disassembly
+type coverageLine struct {
+	location string
+	// source line number, 0 without source
+	line   int
+	offset int
+	size   int
+	text   string
+}
+
+func (s *Sim) coverageLines(prog *Program, f Formatter) []coverageLine {
+	var result []coverageLine
+
+	if prog != nil {
+		for _, l := range prog.lines {
+			if !l.data {
+				result = append(result, coverageLine{fmt.Sprintf("%4d", l.line), l.line, l.offset, l.size, l.text})
+			}
+		}
+		return result
+	}
+
+	for addr := 0; addr < s.initSize; {
+		text, size := s.instructionText(addr, f)
+		if size == 0 {
+			// the rest as one line
+			size = s.initSize - addr
+			text = f.Comment() + " undecodable"
+		}
+
+		result = append(result, coverageLine{fmt.Sprintf("%04x", addr), 0, addr, size, text})
+		addr += size
+	}
+
+	return result
+}
+
+// executions of the instructions starting in the line
+func (c *Coverage) lineHits(l *coverageLine) int {
+	hits := 0
+	for addr := l.offset; addr < l.offset+l.size; addr++ {
+		hits += c.hits[addr]
+	}
+	return hits
+}
+
+// conditional branches of the line, executed or not
+func (s *Sim) lineBranches(l *coverageLine) []int {
+	var result []int
+
+	for addr := l.offset; addr < l.offset+l.size; {
+		cmd, size, err := decodeOne(s.mem[addr : l.offset+l.size])
+		if err != nil {
+			break
+		}
+
+		if _, ok := cmd.(*JumpOrLoop); ok {
+			result = append(result, addr)
+		}
+		addr += size
+	}
+
+	return result
+}
+
+// executed bytes of the lines
+func (c *Coverage) executedBytes(lines []coverageLine) (int, int) {
+	executed := map[int]bool{}
+	for addr, size := range c.sizes {
+		for a := addr; a < addr+size; a++ {
+			executed[a] = true
+		}
+	}
+
+	hit, total := 0, 0
+	for _, l := range lines {
+		for a := l.offset; a < l.offset+l.size; a++ {
+			hit += boolInt(executed[a])
+		}
+		total += l.size
+	}
+
+	return hit, total
+}
+
+// executed branch directions and all of them, two per branch
+func (c *Coverage) directions(s *Sim, lines []coverageLine) (int, int) {
+	hit, total := 0, 0
+
+	for idx := range lines {
+		for _, addr := range s.lineBranches(&lines[idx]) {
+			if b := c.branches[addr]; b != nil {
+				hit += boolInt(b.taken > 0) + boolInt(b.notTaken > 0)
+			}
+			total += 2
+		}
+	}
+
+	return hit, total
+}
+
+func (c *Coverage) report(w io.Writer, s *Sim, prog *Program, f Formatter) {
+	lines := s.coverageLines(prog, f)
+
+	bytesHit, bytesTotal := c.executedBytes(lines)
+	dirHit, dirTotal := c.directions(s, lines)
+
+	fmt.Fprintf(w, "Coverage: %d/%d bytes (%s), %d/%d branch directions (%s)\n",
+		bytesHit, bytesTotal, percent(bytesHit, bytesTotal), dirHit, dirTotal, percent(dirHit, dirTotal))
+
+	for idx := range lines {
+		l := &lines[idx]
+
+		count := "#####"
+		if hits := c.lineHits(l); hits > 0 {
+			count = fmt.Sprint(hits)
+		}
+
+		text := l.text
+		for _, addr := range s.lineBranches(l) {
+			if b := c.branches[addr]; b != nil {
+				text = fmt.Sprintf("%s %s %s", text, f.Comment(), b.String())
+			}
+		}
+
+		fmt.Fprintf(w, "%10s  %s  %s\n", count, l.location, text)
+	}
+}
+
+// lcov tracefile for the .asm source at `source`
+func (c *Coverage) writeLCOV(fp string, s *Sim, prog *Program, source string) error {
+	if prog == nil {
+		return fmt.Errorf("lcov needs an .asm source")
+	}
+
+	abs, err := filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "TN:\nSF:%s\n", abs)
+
+	lines := s.coverageLines(prog, NASM)
+
+	for idx := range lines {
+		l := &lines[idx]
+
+		for block, addr := range s.lineBranches(l) {
+			// `-` when the branch never ran
+			taken, notTaken := "-", "-"
+			if br := c.branches[addr]; br != nil {
+				taken, notTaken = fmt.Sprint(br.taken), fmt.Sprint(br.notTaken)
+			}
+
+			fmt.Fprintf(b, "BRDA:%d,%d,0,%s\n", l.line, block, taken)
+			fmt.Fprintf(b, "BRDA:%d,%d,1,%s\n", l.line, block, notTaken)
+		}
+	}
+
+	dirHit, dirTotal := c.directions(s, lines)
+	fmt.Fprintf(b, "BRF:%d\nBRH:%d\n", dirTotal, dirHit)
+
+	linesHit := 0
+	for idx := range lines {
+		hits := c.lineHits(&lines[idx])
+		linesHit += boolInt(hits > 0)
+		fmt.Fprintf(b, "DA:%d,%d\n", lines[idx].line, hits)
+	}
+
+	fmt.Fprintf(b, "LF:%d\nLH:%d\nend_of_record\n", len(lines), linesHit)
+
+	return os.WriteFile(fp, []byte(b.String()), 0644)
+}
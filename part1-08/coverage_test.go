@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a taken branch to the next instruction counts as taken
+func TestCoverageBranchToNextInstruction(t *testing.T) {
+	src := "bits 16\nmov cx, 1\nsub cx, 1\njz next\nnext:\nmov ax, 1\n"
+	prog := assembleSource(t, src)
+
+	s := newSim(prog.code)
+	s.coverage = newCoverage()
+	runSim(t, s)
+
+	b := s.coverage.branches[6]
+	if b == nil || b.taken != 1 || b.notTaken != 0 {
+		t.Fatalf("jz coverage: %+v, want taken once", b)
+	}
+
+	source := filepath.Join(t.TempDir(), "jz.asm")
+	if err := os.WriteFile(source, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info := filepath.Join(t.TempDir(), "jz.info")
+	if err := s.coverage.writeLCOV(info, s, prog, source); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"BRDA:4,0,0,1", "BRDA:4,0,1,0", "BRH:1"} {
+		if !strings.Contains(string(buf), line+"\n") {
+			t.Errorf("lcov doesn't have %s:\n%s", line, buf)
+		}
+	}
+}
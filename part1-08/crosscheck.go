@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// differential check of the block engine against the step interpreter
+//
+// Each program runs on both, with the cpu model and limits from the
+// flags. Every instruction's ip, flags, clocks and interrupt go into a
+// running hash, and the final machine state, clocks and the error that
+// stopped the run have to be the same.
+
+type engineRun struct {
+	count  int
+	trace  uint64
+	state  uint64
+	clocks int
+	stalls int
+	err    string
+}
+
+func (r *engineRun) record(d *Delta) {
+	r.count += 1
+
+	for _, v := range []int{d.oldIP, d.newIP, int(d.newFlags.word()), d.clocks.total(), boolInt(d.irq), int(d.vector)} {
+		r.trace = mix64(bits.RotateLeft64(r.trace, 5) ^ uint64(v))
+	}
+}
+
+func (r *engineRun) finish(s *Sim, err error) {
+	r.state = s.stateHash()
+	r.clocks = s.totalClocks
+	r.stalls = s.totalStalls
+
+	if err != nil {
+		r.err = err.Error()
+	}
+}
+
+func (r *engineRun) String() string {
+	return fmt.Sprintf("%d instructions, %d clocks, %d stalls, trace %016x, state %016x, error %q",
+		r.count, r.clocks, r.stalls, r.trace, r.state, r.err)
+}
+
+func runStepEngine(s *Sim, limiter *Limiter) *engineRun {
+	s.trace = false
+
+	result := &engineRun{}
+
+	var err error
+	for err == nil {
+		var ins *Ins
+		ins, err = s.decode()
+		if err != nil || ins == nil {
+			break
+		}
+
+		var d Delta
+		d, err = s.execIns(ins)
+		if err != nil {
+			break
+		}
+
+		result.record(&d)
+		err = limiter.check(s, &d)
+	}
+
+	result.finish(s, err)
+	return result
+}
+
+func runBlockEngine(s *Sim, limiter *Limiter) *engineRun {
+	s.trace = false
+	s.blocks = newBlockEngine()
+
+	result := &engineRun{}
+
+	err := s.blocks.run(s, func(d *Delta) error {
+		result.record(d)
+		return limiter.check(s, d)
+	})
+
+	result.finish(s, err)
+	return result
+}
+
+// return false if the engines disagree on any program
+func runCrosscheck(files []string) bool {
+	ok := true
+
+	for _, file := range files {
+		code, _, err := loadProgram(file)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", file, err)
+			ok = false
+			continue
+		}
+
+		step := runStepEngine(setupSim(code), newLimiter(*maxInstructionsFlag, *maxClocksFlag))
+		blocks := runBlockEngine(setupSim(code), newLimiter(*maxInstructionsFlag, *maxClocksFlag))
+
+		if *step != *blocks {
+			fmt.Printf("FAIL %s\n     step:   %s\n     blocks: %s\n", file, step, blocks)
+			ok = false
+		} else {
+			fmt.Printf("ok   %s: %d instructions\n", file, step.count)
+		}
+	}
+
+	return ok
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// debug adapter protocol server, `-dap addr`
+//
+// The client launches the program with `{"program": "listing.asm",
+// "stopOnEntry": true}`, e.g. a VS Code launch configuration with
+// `"debugServer": 4711`. Breakpoints and stack frames map source lines of
+// `.asm` files to instruction offsets, binaries only have the
+// disassembly. There is one thread and one stack frame, the scopes are
+// registers and flags, and memory is addressed physically.
+
+const (
+	dapThreadID = 1
+	dapFrameID  = 1
+
+	// variablesReference of the scopes
+	dapRegisters = 1
+	dapFlags     = 2
+
+	// largest message body, requests are small json objects
+	dapMaxContentLength = 1 << 20
+)
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapResponse struct {
+	Seq        int    `json:"seq"`
+	Type       string `json:"type"`
+	RequestSeq int    `json:"request_seq"`
+	Success    bool   `json:"success"`
+	Command    string `json:"command"`
+	Message    string `json:"message,omitempty"`
+	Body       any    `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int    `json:"seq"`
+	Type  string `json:"type"`
+	Event string `json:"event"`
+	Body  any    `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type dapBreakpoint struct {
+	Verified bool   `json:"verified"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+	MemoryReference    string `json:"memoryReference,omitempty"`
+}
+
+// requests from the reader goroutine
+type dapIncoming struct {
+	req *dapRequest
+	err error
+}
+
+type DAPServer struct {
+	conn     io.Writer
+	seq      int
+	requests chan dapIncoming
+	// requests received while running, handled after stopping
+	pending []*dapRequest
+
+	// creates the machine of a launched program
+	setup func(buf []byte) *Sim
+
+	// set by launch
+	sim  *Sim
+	prog *Program
+	path string
+
+	stopOnEntry bool
+	breakpoints map[int]bool
+	// the program reached the end
+	done bool
+}
+
+// listen on addr and serve one client
+func serveDAP(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	fmt.Printf("dap: listening on %s\n", listener.Addr())
+
+	conn, err := listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	server := newDAPServer(conn, setupSim)
+	go server.readRequests(conn)
+
+	return server.serve()
+}
+
+func newDAPServer(conn io.Writer, setup func(buf []byte) *Sim) *DAPServer {
+	return &DAPServer{
+		conn:        conn,
+		requests:    make(chan dapIncoming, 16),
+		setup:       setup,
+		breakpoints: map[int]bool{},
+	}
+}
+
+// `Content-Length: n\r\n\r\n` followed by the json body
+func (d *DAPServer) readRequests(conn io.Reader) {
+	r := textproto.NewReader(bufio.NewReader(conn))
+
+	for {
+		header, err := r.ReadMIMEHeader()
+		if err != nil {
+			d.requests <- dapIncoming{err: err}
+			return
+		}
+
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			d.requests <- dapIncoming{err: fmt.Errorf("invalid Content-Length: %v", err)}
+			return
+		}
+
+		if length < 0 || length > dapMaxContentLength {
+			d.requests <- dapIncoming{err: fmt.Errorf("invalid Content-Length: %d", length)}
+			return
+		}
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r.R, body); err != nil {
+			d.requests <- dapIncoming{err: err}
+			return
+		}
+
+		req := &dapRequest{}
+		if err := json.Unmarshal(body, req); err != nil {
+			d.requests <- dapIncoming{err: fmt.Errorf("invalid message: %v", err)}
+			return
+		}
+
+		d.requests <- dapIncoming{req: req}
+	}
+}
+
+func (d *DAPServer) send(msg any) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(d.conn, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+func (d *DAPServer) respond(req *dapRequest, body any, err error) error {
+	d.seq += 1
+	resp := dapResponse{Seq: d.seq, Type: "response", RequestSeq: req.Seq, Command: req.Command, Success: err == nil, Body: body}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+	return d.send(resp)
+}
+
+func (d *DAPServer) event(name string, body any) error {
+	d.seq += 1
+	return d.send(dapEvent{Seq: d.seq, Type: "event", Event: name, Body: body})
+}
+
+func (d *DAPServer) serve() error {
+	for {
+		var req *dapRequest
+
+		if len(d.pending) > 0 {
+			req, d.pending = d.pending[0], d.pending[1:]
+		} else {
+			in := <-d.requests
+			if in.err == io.EOF {
+				return nil
+			}
+			if in.err != nil {
+				return in.err
+			}
+			req = in.req
+		}
+
+		quit, err := d.handle(req)
+		if err != nil || quit {
+			return err
+		}
+	}
+}
+
+// quit after disconnect
+func (d *DAPServer) handle(req *dapRequest) (bool, error) {
+	if d.sim == nil && req.Command != "initialize" && req.Command != "launch" && req.Command != "disconnect" {
+		return false, d.respond(req, nil, errors.New("program is not launched"))
+	}
+
+	switch req.Command {
+	case "initialize":
+		return false, d.respond(req, map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsSetVariable":              true,
+			"supportsEvaluateForHovers":        true,
+			"supportsReadMemoryRequest":        true,
+			"supportsTerminateRequest":         true,
+		}, nil)
+	case "launch":
+		{
+			if err := d.launch(req.Arguments); err != nil {
+				return false, d.respond(req, nil, err)
+			}
+
+			if err := d.respond(req, nil, nil); err != nil {
+				return false, err
+			}
+
+			// ready for breakpoints
+			return false, d.event("initialized", nil)
+		}
+	case "configurationDone":
+		{
+			if err := d.respond(req, nil, nil); err != nil {
+				return false, err
+			}
+
+			if d.stopOnEntry {
+				return false, d.stopped("entry")
+			}
+			return false, d.run(false)
+		}
+	case "setBreakpoints":
+		{
+			body, err := d.setBreakpoints(req.Arguments)
+			return false, d.respond(req, body, err)
+		}
+	case "threads":
+		return false, d.respond(req, map[string]any{
+			"threads": []map[string]any{{"id": dapThreadID, "name": "main"}},
+		}, nil)
+	case "stackTrace":
+		return false, d.respond(req, d.stackTrace(), nil)
+	case "scopes":
+		return false, d.respond(req, map[string]any{
+			"scopes": []map[string]any{
+				{"name": "Registers", "variablesReference": dapRegisters, "expensive": false},
+				{"name": "Flags", "variablesReference": dapFlags, "expensive": false},
+			},
+		}, nil)
+	case "variables":
+		{
+			body, err := d.variables(req.Arguments)
+			return false, d.respond(req, body, err)
+		}
+	case "setVariable":
+		{
+			body, err := d.setVariable(req.Arguments)
+			return false, d.respond(req, body, err)
+		}
+	case "evaluate":
+		{
+			body, err := d.evaluate(req.Arguments)
+			return false, d.respond(req, body, err)
+		}
+	case "readMemory":
+		{
+			body, err := d.readMemory(req.Arguments)
+			return false, d.respond(req, body, err)
+		}
+	case "next", "stepIn", "stepOut":
+		{
+			// no calls, every step is one instruction
+			if err := d.respond(req, nil, nil); err != nil {
+				return false, err
+			}
+			return false, d.run(true)
+		}
+	case "continue":
+		{
+			if err := d.respond(req, map[string]any{"allThreadsContinued": true}, nil); err != nil {
+				return false, err
+			}
+			return false, d.run(false)
+		}
+	case "pause":
+		// only running programs can be paused, see run
+		return false, d.respond(req, nil, nil)
+	case "terminate":
+		{
+			if err := d.respond(req, nil, nil); err != nil {
+				return false, err
+			}
+			return false, d.event("terminated", nil)
+		}
+	case "disconnect":
+		return true, d.respond(req, nil, nil)
+	}
+
+	return false, d.respond(req, nil, fmt.Errorf("unsupported command %s", req.Command))
+}
+
+func (d *DAPServer) launch(arguments json.RawMessage) error {
+	var args struct {
+		Program     string `json:"program"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return err
+	}
+
+	if args.Program == "" {
+		return errors.New("program is required")
+	}
+
+	buf, prog, err := loadProgram(args.Program)
+	if err != nil {
+		return err
+	}
+
+	path, err := filepath.Abs(args.Program)
+	if err != nil {
+		return err
+	}
+
+	d.sim = d.setup(buf)
+	d.prog = prog
+	d.path = path
+	d.stopOnEntry = args.StopOnEntry
+
+	return nil
+}
+
+func (d *DAPServer) stopped(reason string) error {
+	return d.event("stopped", map[string]any{
+		"reason":            reason,
+		"threadId":          dapThreadID,
+		"allThreadsStopped": true,
+	})
+}
+
+func (d *DAPServer) terminated() error {
+	d.done = true
+
+	if err := d.event("exited", map[string]any{"exitCode": 0}); err != nil {
+		return err
+	}
+	return d.event("terminated", nil)
+}
+
+// execute one instruction, or until a breakpoint, pause or the end
+func (d *DAPServer) run(single bool) error {
+	if d.done {
+		return d.terminated()
+	}
+
+	for {
+		cmd, _, err := d.sim.step()
+
+		if err != nil {
+			if err := d.event("output", map[string]any{"category": "stderr", "output": err.Error() + "\n"}); err != nil {
+				return err
+			}
+			return d.stopped("exception")
+		}
+
+		if cmd == nil {
+			return d.terminated()
+		}
+
+		if single {
+			return d.stopped("step")
+		}
+
+		if d.breakpoints[d.sim.ip] {
+			return d.stopped("breakpoint")
+		}
+
+		select {
+		case in := <-d.requests:
+			{
+				if in.err != nil {
+					return in.err
+				}
+
+				if in.req.Command == "pause" {
+					if err := d.respond(in.req, nil, nil); err != nil {
+						return err
+					}
+					return d.stopped("pause")
+				}
+
+				d.pending = append(d.pending, in.req)
+
+				// the client is leaving
+				if in.req.Command == "disconnect" || in.req.Command == "terminate" {
+					return d.stopped("pause")
+				}
+			}
+		default:
+		}
+	}
+}
+
+// breakpoints of the only source file replace the existing ones
+func (d *DAPServer) setBreakpoints(arguments json.RawMessage) (any, error) {
+	var args struct {
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	d.breakpoints = map[int]bool{}
+	result := []dapBreakpoint{}
+
+	for _, bp := range args.Breakpoints {
+		if d.prog == nil {
+			result = append(result, dapBreakpoint{Verified: false, Message: "no source for binaries"})
+			continue
+		}
+
+		// moved to the next instruction
+		line := d.prog.lineFrom(bp.Line)
+		if line == nil {
+			result = append(result, dapBreakpoint{Verified: false, Line: bp.Line, Message: "no instruction"})
+			continue
+		}
+
+		d.breakpoints[line.offset] = true
+		result = append(result, dapBreakpoint{Verified: true, Line: line.line})
+	}
+
+	return map[string]any{"breakpoints": result}, nil
+}
+
+func (d *DAPServer) stackTrace() any {
+	frame := map[string]any{
+		"id":                          dapFrameID,
+		"name":                        "end of program",
+		"line":                        0,
+		"column":                      0,
+		"instructionPointerReference": fmt.Sprintf("0x%x", d.sim.ip),
+	}
+
+	if cmd, err := d.sim.disassemble(); err == nil && cmd != nil {
+		frame["name"] = cmd.Disassemble()
+	}
+
+	if d.prog != nil {
+		frame["source"] = dapSource{Name: filepath.Base(d.path), Path: d.path}
+
+		if line := d.prog.lineAt(d.sim.ip); line != nil {
+			frame["line"] = line.line
+			frame["column"] = 1
+		}
+	}
+
+	return map[string]any{"stackFrames": []any{frame}, "totalFrames": 1}
+}
+
+func (d *DAPServer) variables(arguments json.RawMessage) (any, error) {
+	var args struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	s := d.sim
+	result := []dapVariable{}
+
+	switch args.VariablesReference {
+	case dapRegisters:
+		{
+			for idx, name := range REGISTERS_16 {
+				// memory the register points to, sp and bp use ss
+				var sr byte = 3
+				if idx == 4 || idx == 5 {
+					sr = 2
+				}
+
+				result = append(result, dapVariable{
+					Name:            name,
+					Value:           fmt.Sprintf("0x%04x", s.regs[idx]),
+					MemoryReference: fmt.Sprintf("0x%x", s.physicalAddress(sr, s.regs[idx])),
+				})
+			}
+
+			for idx, name := range SEGMENT_REGISTERS {
+				result = append(result, dapVariable{Name: name, Value: fmt.Sprintf("0x%04x", s.sregs[idx])})
+			}
+
+			result = append(result, dapVariable{Name: "ip", Value: fmt.Sprintf("0x%04x", s.ip)})
+		}
+	case dapFlags:
+		{
+			result = append(result, dapVariable{Name: "ZF", Value: dapBool(s.flags.zero)})
+			result = append(result, dapVariable{Name: "SF", Value: dapBool(s.flags.sign)})
+			result = append(result, dapVariable{Name: "IF", Value: dapBool(s.flags.interrupt)})
+		}
+	default:
+		return nil, fmt.Errorf("unknown variablesReference %d", args.VariablesReference)
+	}
+
+	return map[string]any{"variables": result}, nil
+}
+
+func dapBool(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+
+func (d *DAPServer) setVariable(arguments json.RawMessage) (any, error) {
+	var args struct {
+		VariablesReference int    `json:"variablesReference"`
+		Name               string `json:"name"`
+		Value              string `json:"value"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	val, err := parseNumber(strings.TrimSpace(args.Value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %s", args.Value)
+	}
+
+	switch true {
+	case args.VariablesReference == dapRegisters:
+		{
+			if err := d.sim.setRegister(args.Name, uint16(val)); err != nil {
+				return nil, err
+			}
+			v, _ := d.sim.getRegister(args.Name)
+			return map[string]any{"value": fmt.Sprintf("0x%04x", v)}, nil
+		}
+	case args.VariablesReference == dapFlags && args.Name == "ZF":
+		d.sim.flags.zero = val != 0
+	case args.VariablesReference == dapFlags && args.Name == "SF":
+		d.sim.flags.sign = val != 0
+	case args.VariablesReference == dapFlags && args.Name == "IF":
+		d.sim.flags.interrupt = val != 0
+	default:
+		return nil, fmt.Errorf("unknown variable %s", args.Name)
+	}
+
+	return map[string]any{"value": dapBool(val != 0)}, nil
+}
+
+// registers and numbers, e.g. hovering `bx`
+func (d *DAPServer) evaluate(arguments json.RawMessage) (any, error) {
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	v, err := d.sim.parseValue(strings.TrimSpace(args.Expression))
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]any{
+		"result":             fmt.Sprintf("0x%04x (%d)", v, v),
+		"variablesReference": 0,
+	}, nil
+}
+
+// memoryReference is a physical address
+func (d *DAPServer) readMemory(arguments json.RawMessage) (any, error) {
+	var args struct {
+		MemoryReference string `json:"memoryReference"`
+		Offset          int    `json:"offset"`
+		Count           int    `json:"count"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	base, err := parseNumber(args.MemoryReference)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memoryReference %s", args.MemoryReference)
+	}
+
+	if args.Count < 0 {
+		return nil, fmt.Errorf("invalid count %d", args.Count)
+	}
+
+	addr := base + args.Offset
+	if addr < 0 || addr >= memSize {
+		return map[string]any{"address": fmt.Sprintf("0x%x", addr), "unreadableBytes": args.Count}, nil
+	}
+
+	count := min(args.Count, memSize-addr)
+
+	return map[string]any{
+		"address":         fmt.Sprintf("0x%x", addr),
+		"data":            base64.StdEncoding.EncodeToString(d.sim.mem[addr : addr+count]),
+		"unreadableBytes": args.Count - count,
+	}, nil
+}
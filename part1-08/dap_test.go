@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type dapMessage struct {
+	Type       string          `json:"type"`
+	Event      string          `json:"event"`
+	Command    string          `json:"command"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type dapClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *textproto.Reader
+	seq  int
+	// serve returned
+	done chan error
+}
+
+// client of a server on the other end of a pipe
+func newDAPClient(t *testing.T) *dapClient {
+	client, conn := net.Pipe()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+
+	server := newDAPServer(conn, newSim)
+	done := make(chan error, 1)
+	go server.readRequests(conn)
+	go func() {
+		done <- server.serve()
+		conn.Close()
+	}()
+
+	t.Cleanup(func() { client.Close() })
+
+	return &dapClient{t: t, conn: client, r: textproto.NewReader(bufio.NewReader(client)), done: done}
+}
+
+func (c *dapClient) read() *dapMessage {
+	c.t.Helper()
+
+	header, err := c.r.ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatalf("read header: %v", err)
+	}
+
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		c.t.Fatalf("invalid Content-Length: %v", err)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.r.R, body); err != nil {
+		c.t.Fatalf("read body: %v", err)
+	}
+
+	msg := &dapMessage{}
+	if err := json.Unmarshal(body, msg); err != nil {
+		c.t.Fatalf("invalid message %s: %v", body, err)
+	}
+	return msg
+}
+
+// the response of the request, events before it are dropped
+func (c *dapClient) request(command string, arguments any) *dapMessage {
+	c.t.Helper()
+
+	c.seq += 1
+	args, _ := json.Marshal(arguments)
+	body, _ := json.Marshal(dapRequest{Seq: c.seq, Type: "request", Command: command, Arguments: args})
+
+	if _, err := fmt.Fprintf(c.conn, "Content-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+		c.t.Fatalf("send %s: %v", command, err)
+	}
+
+	for {
+		msg := c.read()
+		if msg.Type == "response" && msg.RequestSeq == c.seq {
+			return msg
+		}
+	}
+}
+
+// the request has to succeed, its body goes into result
+func (c *dapClient) call(command string, arguments any, result any) {
+	c.t.Helper()
+
+	resp := c.request(command, arguments)
+	if !resp.Success {
+		c.t.Fatalf("%s failed: %s", command, resp.Message)
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(resp.Body, result); err != nil {
+			c.t.Fatalf("%s: invalid body %s: %v", command, resp.Body, err)
+		}
+	}
+}
+
+// the next event has to be name, its body goes into result
+func (c *dapClient) expectEvent(name string, result any) {
+	c.t.Helper()
+
+	msg := c.read()
+	if msg.Type != "event" || msg.Event != name {
+		c.t.Fatalf("got %s %s%s, want event %s", msg.Type, msg.Event, msg.Command, name)
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(msg.Body, result); err != nil {
+			c.t.Fatalf("%s: invalid body %s: %v", name, msg.Body, err)
+		}
+	}
+}
+
+func (c *dapClient) expectStopped(reason string) {
+	c.t.Helper()
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	c.expectEvent("stopped", &body)
+
+	if body.Reason != reason {
+		c.t.Fatalf("stopped by %s, want %s", body.Reason, reason)
+	}
+}
+
+// source line and instruction pointer of the only frame
+func (c *dapClient) expectFrame(line int, ip string) {
+	c.t.Helper()
+
+	var body struct {
+		StackFrames []struct {
+			Line int    `json:"line"`
+			IP   string `json:"instructionPointerReference"`
+		} `json:"stackFrames"`
+	}
+	c.call("stackTrace", map[string]any{"threadId": dapThreadID}, &body)
+
+	if len(body.StackFrames) != 1 {
+		c.t.Fatalf("%d stack frames", len(body.StackFrames))
+	}
+	if f := body.StackFrames[0]; f.Line != line || f.IP != ip {
+		c.t.Fatalf("stopped at line %d ip %s, want line %d ip %s", f.Line, f.IP, line, ip)
+	}
+}
+
+func (c *dapClient) register(name string) string {
+	c.t.Helper()
+
+	var body struct {
+		Variables []dapVariable `json:"variables"`
+	}
+	c.call("variables", map[string]any{"variablesReference": dapRegisters}, &body)
+
+	for _, v := range body.Variables {
+		if v.Name == name {
+			return v.Value
+		}
+	}
+
+	c.t.Fatalf("no register %s", name)
+	return ""
+}
+
+func TestDAPSession(t *testing.T) {
+	c := newDAPClient(t)
+
+	c.call("initialize", map[string]any{"adapterID": "sim8086"}, nil)
+	c.call("launch", map[string]any{"program": "listing/listing_0049_conditional_jumps.asm", "stopOnEntry": true}, nil)
+	c.expectEvent("initialized", nil)
+
+	// the label line moves to `add bx, 10`, there is nothing after the end
+	var bps struct {
+		Breakpoints []dapBreakpoint `json:"breakpoints"`
+	}
+	c.call("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": "listing/listing_0049_conditional_jumps.asm"},
+		"breakpoints": []map[string]any{{"line": 21}, {"line": 30}},
+	}, &bps)
+
+	if len(bps.Breakpoints) != 2 || !bps.Breakpoints[0].Verified || bps.Breakpoints[0].Line != 22 || bps.Breakpoints[1].Verified {
+		t.Fatalf("breakpoints %+v, want line 22 and an unverified one", bps.Breakpoints)
+	}
+
+	c.call("configurationDone", nil, nil)
+	c.expectStopped("entry")
+	c.expectFrame(19, "0x0")
+
+	c.call("next", map[string]any{"threadId": dapThreadID}, nil)
+	c.expectStopped("step")
+	c.expectFrame(20, "0x3")
+
+	c.call("continue", map[string]any{"threadId": dapThreadID}, nil)
+	c.expectStopped("breakpoint")
+	c.expectFrame(22, "0x6")
+
+	// the second time round the loop
+	c.call("continue", map[string]any{"threadId": dapThreadID}, nil)
+	c.expectStopped("breakpoint")
+	c.expectFrame(22, "0x6")
+	if cx := c.register("cx"); cx != "0x0002" {
+		t.Errorf("cx = %s, want 0x0002", cx)
+	}
+
+	// `mov cx, 3`
+	var mem struct {
+		Address string `json:"address"`
+		Data    string `json:"data"`
+	}
+	c.call("readMemory", map[string]any{"memoryReference": "0x0", "count": 3}, &mem)
+	if mem.Address != "0x0" || mem.Data != "uQMA" {
+		t.Errorf("read %s at %s, want uQMA at 0x0", mem.Data, mem.Address)
+	}
+
+	if resp := c.request("readMemory", map[string]any{"memoryReference": "0x0", "count": -1}); resp.Success {
+		t.Errorf("reading a negative count succeeded: %s", resp.Body)
+	}
+
+	c.call("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": "listing/listing_0049_conditional_jumps.asm"},
+		"breakpoints": []map[string]any{},
+	}, nil)
+
+	c.call("continue", map[string]any{"threadId": dapThreadID}, nil)
+	c.expectEvent("exited", nil)
+	c.expectEvent("terminated", nil)
+	if bx := c.register("bx"); bx != "0x0406" {
+		t.Errorf("bx = %s, want 0x0406", bx)
+	}
+
+	c.call("disconnect", nil, nil)
+}
+
+// the server stops with an error instead of allocating the length
+func TestDAPInvalidContentLength(t *testing.T) {
+	for _, length := range []string{"-1", "99999999999", "x"} {
+		t.Run(length, func(t *testing.T) {
+			c := newDAPClient(t)
+
+			if _, err := fmt.Fprintf(c.conn, "Content-Length: %s\r\n\r\n{}", length); err != nil {
+				t.Fatal(err)
+			}
+
+			err := <-c.done
+			if err == nil || !strings.Contains(err.Error(), "Content-Length") {
+				t.Fatalf("got %v, want an invalid Content-Length error", err)
+			}
+		})
+	}
+}
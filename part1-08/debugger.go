@@ -0,0 +1,836 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// interactive step debugger, `-repl`
+
+const debuggerHelp = `commands:
+  s, step [n]                 execute n instructions, default 1
+  c, continue                 run until a breakpoint or the end
+  b, break [offset|label] [if <expr>]
+                              set a breakpoint, list breakpoints without argument
+                                e.g. b loop_start if cx == 0 && flags.Z
+  d, delete <offset|label|all> delete breakpoints
+  watch <target> [if <expr>]  stop after a write to target, a register or addr[,len]
+  rwatch <addr[,len]> [if <expr>]
+                              stop after a read
+  awatch <addr[,len]> [if <expr>]
+                              stop after a read or write
+  xwatch <addr[,len]> [if <expr>]
+                              stop before executing an instruction in the range
+  watches                     list watchpoints
+  unwatch <id|all>            delete watchpoints
+  r, regs                     show registers and flags
+  screen                      show the text mode screen
+  x/<n><f><u> <addr>          examine memory, e.g. x/16xb ds:100
+                                f: x (hex) or d (decimal), u: b (byte) or w (word)
+                                addr: [seg:]offset, seg and offset are numbers or registers
+  set <reg> <value>           modify a register, e.g. set ax 0x10
+  set byte|word <addr> <v>... modify memory, e.g. set byte ds:100 1 2 3
+  rs, reverse-step [n]        undo n instructions, default 1
+  rc, reverse-continue        undo until a breakpoint or the start
+  lastwrite <reg|addr>        undo until the instruction which changed a register,
+                                flags or the byte at a memory address
+  goto <n>                    go forward or backward to instruction count n
+  save <file>                 save the machine state to a snapshot file
+  restore <file>              load a snapshot file, clears the history
+  hist [n]                    last n executed instructions, most recent first
+  l, list [n]                 disassemble n instructions from ip
+  h, help                     show this help
+  q, quit                     exit
+an empty line repeats the last command, changes made by set are not undone`
+
+// executed instructions kept for `hist` and reverse execution
+const historySize = 1 << 18
+
+type historyEntry struct {
+	offset int
+	// disassembled when shown, the memory may be written since
+	code  [maxInsSize]byte
+	delta Delta
+
+	// state before the instruction which deltas don't cover, the prefetch
+	// queue and the timer count change with every instruction
+	prefetch Prefetcher
+	pitNow   int
+	// nil unless the instruction changed them
+	devices *deviceState
+}
+
+// rarely changing state before an instruction
+type deviceState struct {
+	video     Video
+	channels  [3]PITChannel
+	pic       PIC
+	installed [vectorTableSize / 64]uint64
+}
+
+func (s *Sim) deviceState() deviceState {
+	return deviceState{s.video, s.pit.channels, s.pic, s.installed}
+}
+
+type Debugger struct {
+	sim *Sim
+	// source of the program, nil for binaries
+	prog *Program
+	out  io.Writer
+
+	// execute watchpoints of size 1 in the simulator
+	breakpoints map[int]*Watchpoint
+	history     []historyEntry
+	// instructions dropped from the front of history
+	dropped int
+	// the program reached the end
+	done bool
+}
+
+func newDebugger(sim *Sim, prog *Program, out io.Writer) *Debugger {
+	return &Debugger{
+		sim:         sim,
+		prog:        prog,
+		out:         out,
+		breakpoints: map[int]*Watchpoint{},
+	}
+}
+
+func (d *Debugger) printf(format string, args ...any) {
+	fmt.Fprintf(d.out, format, args...)
+}
+
+func (d *Debugger) run(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	last := ""
+
+	d.printf("sim0086 debugger, type `help` for commands\n")
+	d.printNext()
+
+	for {
+		d.printf("(sim) ")
+
+		if !scanner.Scan() {
+			d.printf("\n")
+			return
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			line = last
+		}
+		if line == "" {
+			continue
+		}
+		last = line
+
+		if quit := d.command(line); quit {
+			return
+		}
+	}
+}
+
+// return true to quit
+func (d *Debugger) command(line string) bool {
+	fields := strings.Fields(line)
+	name, args := fields[0], fields[1:]
+
+	var err error
+
+	switch true {
+	case name == "s" || name == "step":
+		err = d.cmdStep(args)
+	case name == "c" || name == "continue":
+		err = d.cmdContinue()
+	case name == "b" || name == "break":
+		err = d.cmdBreak(args)
+	case name == "d" || name == "delete":
+		err = d.cmdDelete(args)
+	case name == "watch":
+		err = d.cmdWatch(Watch_Write, args)
+	case name == "rwatch":
+		err = d.cmdWatch(Watch_Read, args)
+	case name == "awatch":
+		err = d.cmdWatch(Watch_Read|Watch_Write, args)
+	case name == "xwatch":
+		err = d.cmdWatch(Watch_Execute, args)
+	case name == "watches":
+		d.cmdWatches()
+	case name == "unwatch":
+		err = d.cmdUnwatch(args)
+	case name == "r" || name == "regs":
+		d.printf("Registers:\n%s%s", d.sim.registerLines(), d.sim.dumpFlags())
+	case name == "screen":
+		d.sim.renderScreen(d.out)
+	case name == "x" || strings.HasPrefix(name, "x/"):
+		err = d.cmdExamine(name, args)
+	case name == "set":
+		err = d.cmdSet(args)
+	case name == "rs" || name == "reverse-step":
+		err = d.cmdReverseStep(args)
+	case name == "rc" || name == "reverse-continue":
+		d.cmdReverseContinue()
+	case name == "lastwrite":
+		err = d.cmdLastWrite(args)
+	case name == "goto":
+		err = d.cmdGoto(args)
+	case name == "save":
+		err = d.cmdSave(args)
+	case name == "restore":
+		err = d.cmdRestore(args)
+	case name == "hist":
+		err = d.cmdHistory(args)
+	case name == "l" || name == "list":
+		err = d.cmdList(args)
+	case name == "h" || name == "help":
+		d.printf("%s\n", debuggerHelp)
+	case name == "q" || name == "quit":
+		return true
+	default:
+		err = fmt.Errorf("unknown command %s, type `help` for commands", name)
+	}
+
+	if err != nil {
+		d.printf("error: %v\n", err)
+	}
+
+	return false
+}
+
+// execute one instruction, return false at the end
+func (d *Debugger) step() (bool, error) {
+	if d.done {
+		return false, nil
+	}
+
+	entry := historyEntry{offset: d.sim.ip, pitNow: d.sim.pit.now}
+	copy(entry.code[:], d.sim.mem[entry.offset:])
+	if d.sim.prefetch != nil {
+		entry.prefetch = *d.sim.prefetch
+	}
+
+	devices := d.sim.deviceState()
+
+	cmd, delta, err := d.sim.step()
+	if err != nil {
+		return false, err
+	}
+
+	if cmd == nil {
+		d.done = true
+		d.printf("program finished\n")
+		return false, nil
+	}
+
+	entry.delta = delta
+	if d.sim.deviceState() != devices {
+		saved := devices
+		entry.devices = &saved
+	}
+
+	d.history = append(d.history, entry)
+	if len(d.history) > historySize {
+		d.dropped += len(d.history) - historySize
+		d.history = d.history[len(d.history)-historySize:]
+	}
+
+	return true, nil
+}
+
+func (d *Debugger) cmdStep(args []string) error {
+	n := 1
+	if len(args) > 0 {
+		v, err := parseNumber(args[0])
+		if err != nil || v <= 0 {
+			return fmt.Errorf("invalid count %s", args[0])
+		}
+		n = v
+	}
+
+	for i := 0; i < n; i++ {
+		ok, err := d.step()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		last := &d.history[len(d.history)-1]
+		d.printf("%s ; %s\n", d.formatEntry(last), last.delta.String())
+
+		if d.printWatchHits() {
+			break
+		}
+	}
+
+	d.printNext()
+	return nil
+}
+
+func (d *Debugger) cmdContinue() error {
+	count := 0
+
+	for {
+		ok, err := d.step()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			d.printf("executed %d instructions\n", count)
+			return nil
+		}
+		count += 1
+
+		if d.printWatchHits() {
+			d.printf("executed %d instructions\n", count)
+			d.printNext()
+			return nil
+		}
+	}
+}
+
+// breakpoints and watchpoints triggered by the last instruction, return
+// true if there are any
+func (d *Debugger) printWatchHits() bool {
+	for _, hit := range d.sim.watchHits {
+		if bp := d.breakpoints[hit.addr]; bp == hit.wp {
+			d.printf("breakpoint at %s\n", d.formatOffset(hit.addr))
+		} else {
+			d.printf("%s\n", hit.String())
+		}
+	}
+
+	return len(d.sim.watchHits) > 0
+}
+
+func (d *Debugger) cmdBreak(args []string) error {
+	if len(args) == 0 {
+		var offsets []int
+		for offset := range d.breakpoints {
+			offsets = append(offsets, offset)
+		}
+		sort.Ints(offsets)
+
+		if len(offsets) == 0 {
+			d.printf("no breakpoints\n")
+		}
+		for _, offset := range offsets {
+			if bp := d.breakpoints[offset]; bp.cond != nil {
+				d.printf("  %s if %s\n", d.formatOffset(offset), bp.condText)
+			} else {
+				d.printf("  %s\n", d.formatOffset(offset))
+			}
+		}
+		return nil
+	}
+
+	offset, err := d.parseLocation(args[0])
+	if err != nil {
+		return err
+	}
+
+	cond, condText, err := parseCondition(args[1:])
+	if err != nil {
+		return err
+	}
+
+	// replaces the condition of an existing one
+	if bp := d.breakpoints[offset]; bp != nil {
+		d.sim.deleteWatchpoint(bp.id)
+	}
+
+	bp := &Watchpoint{kind: Watch_Execute, addr: offset, size: 1, reg: -1, cond: cond, condText: condText}
+	d.sim.addWatchpoint(bp)
+	d.breakpoints[offset] = bp
+
+	d.printf("breakpoint at %s\n", d.formatOffset(offset))
+	return nil
+}
+
+// `if <expr>` after a breakpoint or watchpoint, nil without condition
+func parseCondition(args []string) (Expr, string, error) {
+	if len(args) == 0 {
+		return nil, "", nil
+	}
+
+	if args[0] != "if" || len(args) == 1 {
+		return nil, "", fmt.Errorf("expected if <expr>")
+	}
+
+	text := strings.Join(args[1:], " ")
+
+	cond, err := parseExpr(text)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return cond, text, nil
+}
+
+func (d *Debugger) cmdDelete(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: delete <offset|label|all>")
+	}
+
+	if args[0] == "all" {
+		for _, bp := range d.breakpoints {
+			d.sim.deleteWatchpoint(bp.id)
+		}
+		d.breakpoints = map[int]*Watchpoint{}
+		return nil
+	}
+
+	offset, err := d.parseLocation(args[0])
+	if err != nil {
+		return err
+	}
+
+	bp := d.breakpoints[offset]
+	if bp == nil {
+		return fmt.Errorf("no breakpoint at %s", d.formatOffset(offset))
+	}
+
+	d.sim.deleteWatchpoint(bp.id)
+	delete(d.breakpoints, offset)
+	return nil
+}
+
+// x/16xb ds:100
+func (d *Debugger) cmdExamine(name string, args []string) error {
+	count, format, unit := 16, byte('x'), byte('b')
+
+	if spec := strings.TrimPrefix(name, "x/"); spec != name {
+		letters := strings.TrimLeft(spec, "0123456789")
+		if digits := spec[:len(spec)-len(letters)]; digits != "" {
+			v, err := strconv.Atoi(digits)
+			if err != nil || v <= 0 {
+				return fmt.Errorf("invalid count in %s", name)
+			}
+			count = v
+		}
+
+		for _, c := range []byte(letters) {
+			switch c {
+			case 'x', 'd':
+				format = c
+			case 'b', 'w':
+				unit = c
+			default:
+				return fmt.Errorf("unknown format %c in %s, formats are x and d, units b and w", c, name)
+			}
+		}
+	}
+
+	if len(args) != 1 {
+		return fmt.Errorf("usage: x/<n><f><u> <addr>")
+	}
+
+	addr, err := d.parseAddress(args[0])
+	if err != nil {
+		return err
+	}
+
+	var wide byte
+	size := 1
+	if unit == 'w' {
+		wide, size = 1, 2
+	}
+
+	perLine := 16 / size
+
+	for i := 0; i < count; i++ {
+		if i%perLine == 0 {
+			if i > 0 {
+				d.printf("\n")
+			}
+			d.printf("%05x:", (addr+i*size)%memSize)
+		}
+
+		val := d.sim.peekMem(addr+i*size, wide)
+
+		switch true {
+		case format == 'd':
+			d.printf(" %d", val)
+		case wide == 1:
+			d.printf(" %04x", val)
+		default:
+			d.printf(" %02x", val)
+		}
+	}
+
+	d.printf("\n")
+	return nil
+}
+
+func (d *Debugger) cmdSet(args []string) error {
+	// `set ax=1` is the same as `set ax 1`
+	if len(args) == 1 && strings.Contains(args[0], "=") {
+		args = strings.SplitN(args[0], "=", 2)
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("usage: set <reg> <value> or set byte|word <addr> <value>...")
+	}
+
+	if args[0] == "byte" || args[0] == "word" {
+		var wide byte
+		if args[0] == "word" {
+			wide = 1
+		}
+
+		if len(args) < 3 {
+			return fmt.Errorf("usage: set byte|word <addr> <value>...")
+		}
+
+		addr, err := d.parseAddress(args[1])
+		if err != nil {
+			return err
+		}
+
+		for idx, str := range args[2:] {
+			v, err := parseNumber(str)
+			if err != nil {
+				return fmt.Errorf("invalid value %s", str)
+			}
+			d.sim.pokeMem(addr+idx*(int(wide)+1), uint16(v), wide)
+		}
+
+		return nil
+	}
+
+	v, err := parseNumber(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid value %s", args[1])
+	}
+
+	if err := d.sim.setRegister(args[0], uint16(v)); err != nil {
+		return err
+	}
+
+	// moving ip back into the program runs it again
+	if strings.ToLower(args[0]) == "ip" {
+		d.done = false
+	}
+	return nil
+}
+
+func (d *Debugger) cmdHistory(args []string) error {
+	n := 10
+	if len(args) > 0 {
+		v, err := parseNumber(args[0])
+		if err != nil || v <= 0 {
+			return fmt.Errorf("invalid count %s", args[0])
+		}
+		n = v
+	}
+
+	if len(d.history) == 0 {
+		d.printf("no instructions executed\n")
+	}
+
+	for i := len(d.history) - 1; i >= 0 && i >= len(d.history)-n; i-- {
+		entry := &d.history[i]
+		d.printf("%5d  %s ; %s\n", d.dropped+i+1, d.formatEntry(entry), entry.delta.String())
+	}
+
+	return nil
+}
+
+func (d *Debugger) cmdList(args []string) error {
+	n := 5
+	if len(args) > 0 {
+		v, err := parseNumber(args[0])
+		if err != nil || v <= 0 {
+			return fmt.Errorf("invalid count %s", args[0])
+		}
+		n = v
+	}
+
+	offset := d.sim.ip
+
+	for i := 0; i < n && offset < d.sim.initSize; i++ {
+		r := newReader(d.sim.mem[offset:])
+		cmd, err := decodeCommand(r)
+		if err != nil {
+			return err
+		}
+
+		marker := "  "
+		if i == 0 {
+			marker = "=>"
+		}
+
+		d.printf("%s %s\n", marker, d.formatLine(offset, cmd.Disassemble()))
+		offset += r.idx
+	}
+
+	return nil
+}
+
+// show the instruction to execute next
+func (d *Debugger) printNext() {
+	if d.sim.ip >= d.sim.initSize {
+		d.printf("=> end of program\n")
+		return
+	}
+
+	d.cmdList([]string{"1"})
+}
+
+// `0006 loop_start:  add bx, 10`, with the breakpoint marker
+func (d *Debugger) formatLine(offset int, text string) string {
+	marker := " "
+	if d.breakpoints[offset] != nil {
+		marker = "*"
+	}
+
+	return fmt.Sprintf("%s%-20s %s", marker, d.formatOffset(offset), text)
+}
+
+// the executed instruction as a listing line
+func (d *Debugger) formatEntry(entry *historyEntry) string {
+	text := "(bad)"
+	if cmd, err := decodeCommand(newReader(entry.code[:])); err == nil {
+		text = cmd.Disassemble()
+	}
+
+	return d.formatLine(entry.offset, text)
+}
+
+// `0006 <loop_start>`
+func (d *Debugger) formatOffset(offset int) string {
+	result := fmt.Sprintf("%04x", offset)
+
+	if d.prog != nil {
+		if name := d.prog.labelAt(offset); name != "" {
+			return fmt.Sprintf("%s <%s>", result, name)
+		}
+	}
+
+	return result
+}
+
+// instruction offset, number or label
+func (d *Debugger) parseLocation(str string) (int, error) {
+	if v, err := parseNumber(str); err == nil {
+		return v, nil
+	}
+
+	if d.prog != nil {
+		if offset := d.prog.label(str); offset >= 0 {
+			return offset, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown location %s", str)
+}
+
+// `[seg:]offset` to physical address, seg defaults to ds,
+// each part is a number or a register
+func (d *Debugger) parseAddress(str string) (int, error) {
+	segStr, offStr, found := strings.Cut(str, ":")
+	if !found {
+		segStr, offStr = "ds", str
+	}
+
+	seg, err := d.sim.parseValue(segStr)
+	if err != nil {
+		return 0, err
+	}
+
+	off, err := d.sim.parseValue(offStr)
+	if err != nil {
+		return 0, err
+	}
+
+	return (int(seg)<<4 + int(off)) % memSize, nil
+}
+
+// number or register value
+func (s *Sim) parseValue(str string) (uint16, error) {
+	if v, err := parseNumber(str); err == nil {
+		return uint16(v), nil
+	}
+
+	if v, ok := s.getRegister(str); ok {
+		return v, nil
+	}
+
+	return 0, fmt.Errorf("invalid value %s", str)
+}
+
+// 16-bit, 8-bit or segment register, or ip
+func isRegister(name string) bool {
+	name = strings.ToLower(name)
+
+	return indexOf(REGISTERS_16, name) >= 0 ||
+		indexOf(REGISTERS_8, name) >= 0 ||
+		indexOf(SEGMENT_REGISTERS, name) >= 0 ||
+		name == "ip"
+}
+
+// register by name, including segment registers and ip
+func (s *Sim) getRegister(name string) (uint16, bool) {
+	name = strings.ToLower(name)
+
+	if idx := indexOf(REGISTERS_16, name); idx >= 0 {
+		return s.regs[idx], true
+	}
+	if idx := indexOf(REGISTERS_8, name); idx >= 0 {
+		return s.getReg(byte(idx), 0), true
+	}
+	if idx := indexOf(SEGMENT_REGISTERS, name); idx >= 0 {
+		return s.sregs[idx], true
+	}
+	if name == "ip" {
+		return uint16(s.ip), true
+	}
+
+	return 0, false
+}
+
+func (s *Sim) setRegister(name string, val uint16) error {
+	name = strings.ToLower(name)
+
+	if idx := indexOf(REGISTERS_16, name); idx >= 0 {
+		s.regs[idx] = val
+		return nil
+	}
+	if idx := indexOf(REGISTERS_8, name); idx >= 0 {
+		s.setReg(byte(idx), val, 0)
+		return nil
+	}
+	if idx := indexOf(SEGMENT_REGISTERS, name); idx >= 0 {
+		s.sregs[idx] = val
+		return nil
+	}
+	if name == "ip" {
+		s.ip = int(val)
+		return nil
+	}
+
+	return fmt.Errorf("unknown register %s", name)
+}
+
+// `watch <target> [if <expr>]`, target is a register or `addr[,len]`
+func (d *Debugger) cmdWatch(kind WatchKind, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: watch <reg|addr[,len]> [if <expr>]")
+	}
+
+	cond, condText, err := parseCondition(args[1:])
+	if err != nil {
+		return err
+	}
+
+	w := &Watchpoint{kind: kind, reg: -1, cond: cond, condText: condText}
+
+	if reg, seg := registerIndex(args[0]); reg >= 0 {
+		if kind != Watch_Write {
+			return fmt.Errorf("only writes of registers can be watched")
+		}
+		w.reg, w.seg = reg, seg
+	} else {
+		addrStr, sizeStr, found := strings.Cut(args[0], ",")
+
+		w.addr, err = d.parseAddress(addrStr)
+		if err != nil {
+			return err
+		}
+
+		w.size = 1
+		if found {
+			w.size, err = parseNumber(sizeStr)
+			if err != nil || w.size <= 0 {
+				return fmt.Errorf("invalid length %s", sizeStr)
+			}
+		}
+	}
+
+	d.sim.addWatchpoint(w)
+	d.printf("watchpoint %s\n", w.String())
+	return nil
+}
+
+func (d *Debugger) cmdWatches() {
+	count := 0
+
+	for _, w := range d.sim.watchpoints {
+		if d.breakpoints[w.addr] == w {
+			continue
+		}
+
+		d.printf("  %s\n", w.String())
+		count += 1
+	}
+
+	if count == 0 {
+		d.printf("no watchpoints\n")
+	}
+}
+
+func (d *Debugger) cmdUnwatch(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: unwatch <id|all>")
+	}
+
+	if args[0] == "all" {
+		for _, w := range append([]*Watchpoint{}, d.sim.watchpoints...) {
+			if d.breakpoints[w.addr] != w {
+				d.sim.deleteWatchpoint(w.id)
+			}
+		}
+		return nil
+	}
+
+	id, err := parseNumber(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid watchpoint %s", args[0])
+	}
+
+	for _, w := range d.sim.watchpoints {
+		if w.id == id && d.breakpoints[w.addr] != w {
+			d.sim.deleteWatchpoint(id)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no watchpoint %d", id)
+}
+
+func (d *Debugger) cmdSave(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: save <file>")
+	}
+
+	if err := saveSnapshot(args[0], d.sim); err != nil {
+		return err
+	}
+
+	d.printf("saved to %s at instruction %d\n", args[0], d.count())
+	return nil
+}
+
+func (d *Debugger) cmdRestore(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: restore <file>")
+	}
+
+	if err := loadSnapshot(args[0], d.sim); err != nil {
+		return err
+	}
+
+	// deltas don't apply to the restored state
+	d.history = nil
+	d.dropped = 0
+	d.done = false
+
+	d.printf("restored from %s\n", args[0])
+	d.printNext()
+	return nil
+}
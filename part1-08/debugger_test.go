@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func runDebugger(t *testing.T, file string, input string) string {
+	t.Helper()
+
+	prog, err := assembleFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	newDebugger(newSim(prog.code), prog, out).run(strings.NewReader(input))
+	return out.String()
+}
+
+// deleted breakpoints and watchpoints don't stop the next continue
+func TestDebuggerDeleteThenContinue(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"breakpoint", "b 6\nc\ndelete all\nc\n"},
+		{"watchpoint", "watch bx\nc\nunwatch all\nc\n"},
+		{"xwatch", "xwatch 6\nc\nunwatch all\nc\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := runDebugger(t, "listing/listing_0049_conditional_jumps.asm", tt.input)
+
+			// stopped at the first continue, nothing printed by the delete
+			if !strings.Contains(out, "executed 2 instructions") || !strings.Contains(out, "(sim) (sim) program finished") {
+				t.Errorf("the second continue didn't run to the end:\n%s", out)
+			}
+		})
+	}
+}
+
+// of several labels at an offset, the first one in the source
+func TestDebuggerFormatOffset(t *testing.T) {
+	prog := assembleSource(t, "bits 16\nmov cx, 1\nzz:\nmm:\naa:\nsub cx, 1\n")
+	d := newDebugger(newSim(prog.code), prog, &bytes.Buffer{})
+
+	for i := 0; i < 100; i++ {
+		if got := d.formatOffset(3); got != "0003 <zz>" {
+			t.Fatalf("got %s, want 0003 <zz>", got)
+		}
+	}
+
+	if got := d.formatOffset(0); got != "0000" {
+		t.Errorf("got %s, want 0000", got)
+	}
+}
+
+func TestDebuggerExamineFormat(t *testing.T) {
+	out := runDebugger(t, "listing/listing_0049_conditional_jumps.asm", "x/16q 0\nx/2xw 0\n")
+
+	if !strings.Contains(out, "error: unknown format q in x/16q") {
+		t.Errorf("x/16q wasn't rejected:\n%s", out)
+	}
+	if !strings.Contains(out, "00000: 03b9 bb00") {
+		t.Errorf("x/2xw didn't print two words:\n%s", out)
+	}
+}
+
+// moving ip after the program finished lets it run again
+func TestDebuggerSetIPAfterFinish(t *testing.T) {
+	out := runDebugger(t, "listing/listing_0049_conditional_jumps.asm", "c\nset ip 0\nc\n")
+
+	if got := strings.Count(out, "executed 11 instructions"); got != 2 {
+		t.Errorf("ran to the end %d times, want 2:\n%s", got, out)
+	}
+}
+
+// entries keep the instruction bytes, not the text, and undo restores the
+// devices only when they changed
+func TestDebuggerHistory(t *testing.T) {
+	out := runDebugger(t, "listing/listing_0049_conditional_jumps.asm", "s\ns\nhist\nrs\nrs\n")
+
+	for _, want := range []string{
+		"    1   0000                 mov cx, 3 ; cx:0x0->0x3 ip:0x0->0x3",
+		"    2   0003                 mov bx, 1000 ; bx:0x0->0x3e8 ip:0x3->0x6",
+		"undo  0003                 mov bx, 1000",
+		"undo  0000                 mov cx, 3",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+// undoing the whole history brings back the timer and interrupt state
+func TestDebuggerUndoDevices(t *testing.T) {
+	prog := assembleSource(t, timerLoop)
+	d := newDebugger(newSim(prog.code), prog, &bytes.Buffer{})
+	start := d.sim.deviceState()
+
+	for i := 0; i < 500; i++ {
+		if _, err := d.step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.sim.deviceState() == start {
+		t.Fatal("the program didn't change the devices")
+	}
+
+	for {
+		if _, ok := d.undo(); !ok {
+			break
+		}
+	}
+	if d.sim.deviceState() != start || d.sim.pit.now != 0 {
+		t.Errorf("devices not restored: got %+v, want %+v", d.sim.deviceState(), start)
+	}
+}
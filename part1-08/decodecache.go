@@ -0,0 +1,64 @@
+package main
+
+// flattened instructions of the program, keyed by address, see ins.go
+//
+// Only the program bytes below initSize are ever executed, so the cache
+// is a slice over them. Every memory write goes through pokeByte, which
+// drops the instructions covering the byte, so self-modifying code is
+// decoded again. Loading files or a snapshot replaces memory wholesale
+// and resets the cache.
+
+type DecodeCache struct {
+	// cmd is nil if not decoded yet
+	entries []Ins
+
+	hits   int
+	misses int
+}
+
+func newDecodeCache() *DecodeCache {
+	return &DecodeCache{}
+}
+
+// drop everything, the program may have a different size now
+func (c *DecodeCache) reset() {
+	c.entries = nil
+}
+
+// decoded instruction at addr, decodes and remembers it on a miss
+func (c *DecodeCache) lookup(s *Sim, addr int) (*Ins, error) {
+	if len(c.entries) != s.initSize {
+		c.entries = make([]Ins, s.initSize)
+	}
+
+	e := &c.entries[addr]
+	if e.cmd != nil {
+		c.hits += 1
+		return e, nil
+	}
+
+	c.misses += 1
+
+	r := newReader(s.mem[addr:])
+	cmd, err := decodeCommand(r)
+	if err != nil {
+		return nil, err
+	}
+
+	*e = flatten(cmd, r.idx)
+	return e, nil
+}
+
+// drop the instructions covering addr
+func (c *DecodeCache) invalidate(addr int) {
+	if addr >= len(c.entries) {
+		return
+	}
+
+	for start := max(0, addr-maxInsSize+1); start <= addr; start++ {
+		e := &c.entries[start]
+		if e.cmd != nil && start+e.size > addr {
+			*e = Ins{}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+// the loop patches the immediate of its own `mov cx, 1` to 9
+const selfModifying = `bits 16
+mov dx, 3
+top:
+patch:
+mov cx, 1
+add ax, cx
+mov word [patch+1], 9
+sub dx, 1
+jnz top
+`
+
+func TestDecodeCacheSelfModifying(t *testing.T) {
+	prog := assembleSource(t, selfModifying)
+
+	uncached := newSim(prog.code)
+	uncached.decodeCache = nil
+	want := len(runSim(t, uncached))
+
+	cached := newSim(prog.code)
+	got := len(runSim(t, cached))
+
+	if got != want {
+		t.Errorf("%d instructions with the cache, %d without", got, want)
+	}
+
+	if cached.stateHash() != uncached.stateHash() {
+		t.Errorf("final state differs, registers %v with the cache, %v without", cached.regs, uncached.regs)
+	}
+
+	// 1 + 9 + 9, the stale `mov cx, 1` would give 3
+	if ax := cached.regs[0]; ax != 19 {
+		t.Errorf("ax = %d, want 19", ax)
+	}
+}
@@ -29,53 +29,91 @@ func disassemble(buf []byte) ([]Command, error) {
 	r := newReader(buf)
 
 	for !r.isEmpty() {
-		bs := r.mustPeek(min(4, r.remaining()))
-		firstByte := bs[0]
+		cmd, err := decodeCommand(r)
+		if err != nil {
+			return nil, err
+		}
 
-		var cmd Command
+		if *debugFlag {
+			pp.Println(cmd)
+		}
 
-		switch true {
-		case isMov(firstByte):
-			{
-				mov := parseMov(r)
+		cmds = append(cmds, cmd)
+	}
 
-				if mov.typ == Mov_Invalid {
-					return nil, fmt.Errorf("invalid mov instruction: %#v", bs)
-				}
+	return cmds, nil
+}
 
-				cmd = &mov
-			}
-		case isArithmetic(firstByte):
-			{
-				add := parseArithmetic(r)
+// decode one instruction at the reader position
+func decodeCommand(r *Reader) (Command, error) {
+	bs := r.mustPeek(min(4, r.remaining()))
+	firstByte := bs[0]
 
-				if add.typ == Arithmetic_Invalid {
-					return nil, fmt.Errorf("invalid add instruction: %#v", bs)
-				}
-				cmd = &add
-			}
-		case isJumpOrLoop(firstByte):
-			{
-				j := JumpOrLoop{}
-				j.op = r.mustRead()
-				j.inc = r.mustReadInt8()
+	var cmd Command
 
-				cmd = &j
+	switch true {
+	case isMov(firstByte):
+		{
+			mov := parseMov(r)
+
+			if mov.typ == Mov_Invalid {
+				return nil, fmt.Errorf("invalid mov instruction: %#v", bs)
 			}
-		default:
-			{
-				return nil, fmt.Errorf("unknown instruction: %#v", bs)
+
+			cmd = &mov
+		}
+	case isArithmetic(firstByte):
+		{
+			add := parseArithmetic(r)
+
+			if add.typ == Arithmetic_Invalid {
+				return nil, fmt.Errorf("invalid add instruction: %#v", bs)
 			}
+			cmd = &add
 		}
+	case isJumpOrLoop(firstByte):
+		{
+			j := JumpOrLoop{}
+			j.op = r.mustRead()
+			j.inc = r.mustReadInt8()
 
-		if *debugFlag {
-			pp.Println(cmd)
+			cmd = &j
 		}
+	case isInterrupt(firstByte):
+		{
+			i := Interrupt{}
+			i.op = r.mustRead()
+			if i.op == 0b11001101 {
+				i.vector = r.mustRead()
+			}
 
-		cmds = append(cmds, cmd)
+			cmd = &i
+		}
+	case isStack(firstByte):
+		{
+			cmd = &Stack{op: r.mustRead()}
+		}
+	case isInOut(firstByte):
+		{
+			io := InOut{}
+			io.op = r.mustRead()
+			if (io.op>>3)&1 == 0 {
+				io.port = r.mustRead()
+			}
+
+			cmd = &io
+		}
+	case isControl(firstByte):
+		{
+			cmd = &Control{op: r.mustRead()}
+		}
+	default:
+		{
+			return nil, fmt.Errorf("unknown instruction: %#v", bs)
+		}
 	}
 
-	return cmds, nil
+	return cmd, nil
 }
 
 func isMov(b byte) bool {
@@ -100,6 +138,28 @@ func isJumpOrLoop(b byte) bool {
 	return (b>>4) == 0b0111 || (b>>2) == 0b111000
 }
 
+// int, iret
+func isInterrupt(b byte) bool {
+	return b == 0b11001101 || b == 0b11001111
+}
+
+// push/pop of a register or segment register, pushf, popf
+func isStack(b byte) bool {
+	// 0x0f would be `pop cs`
+	segment := b&0b11100110 == 0b00000110 && b != 0b00001111
+	return (b>>4) == 0b0101 || segment || (b>>1) == 0b1001110
+}
+
+// 1110 v 1 d w, v: port in dx, d: out
+func isInOut(b byte) bool {
+	return (b>>4) == 0b1110 && (b>>2)&1 == 0b1
+}
+
+// cli, sti, hlt
+func isControl(b byte) bool {
+	return b == Control_Cli || b == Control_Sti || b == Control_Hlt
+}
+
 type MovType int
 
 const (
@@ -109,9 +169,14 @@ const (
 	Mov_Immediate_To_RegisterOrMemory
 	Mov_Memory_To_Accumulator
 	Mov_Accumulator_To_Memory
+	Mov_RegisterOrMemory_To_Segment
+	Mov_Segment_To_RegisterOrMemory
 )
 
 type Command interface {
+	// syntax independent representation, see format.go
+	Instruction() Instruction
+	// NASM syntax
 	Disassemble() string
 }
 
@@ -191,9 +256,14 @@ var Loop_Lables = []string{
 	"jcxz",
 }
 
+func (j *JumpOrLoop) Instruction() Instruction {
+	return Instruction{
+		op:       j.opName(),
+		operands: []Operand{relativeOperand(int(j.inc) + 2)},
+	}
+}
 func (j *JumpOrLoop) Disassemble() string {
-	return fmt.Sprintf("%s $%+d", j.opName(), j.inc+2)
-
+	return NASM.Format(j.Instruction())
 }
 func (j *JumpOrLoop) opName() string {
 	if (j.op >> 4) == 0b0111 {
@@ -203,6 +273,153 @@ func (j *JumpOrLoop) opName() string {
 	return Loop_Lables[j.op&0b11]
 }
 
+// int imm8, iret
+type Interrupt struct {
+	op     uint8
+	vector uint8
+}
+
+func (i *Interrupt) isReturn() bool {
+	return i.op == 0b11001111
+}
+
+func (i *Interrupt) Instruction() Instruction {
+	if i.isReturn() {
+		return Instruction{op: "iret"}
+	}
+
+	return Instruction{
+		op:       "int",
+		operands: []Operand{immediateOperand(uint16(i.vector), 0)},
+	}
+}
+func (i *Interrupt) Disassemble() string {
+	return NASM.Format(i.Instruction())
+}
+
+type StackType int
+
+const (
+	Stack_Push_Register StackType = iota
+	Stack_Pop_Register
+	Stack_Push_Segment
+	Stack_Pop_Segment
+	Stack_Pushf
+	Stack_Popf
+)
+
+// push, pop, pushf, popf, always a word
+type Stack struct {
+	op uint8
+}
+
+func (st *Stack) typ() StackType {
+	switch true {
+	case (st.op >> 3) == 0b01010:
+		return Stack_Push_Register
+	case (st.op >> 3) == 0b01011:
+		return Stack_Pop_Register
+	case st.op == 0b10011100:
+		return Stack_Pushf
+	case st.op == 0b10011101:
+		return Stack_Popf
+	case st.op&1 == 0:
+		return Stack_Push_Segment
+	}
+
+	return Stack_Pop_Segment
+}
+
+// register or segment register index
+func (st *Stack) reg() byte {
+	switch st.typ() {
+	case Stack_Push_Register, Stack_Pop_Register:
+		return st.op & 0b111
+	}
+
+	return (st.op >> 3) & 0b11
+}
+
+func (st *Stack) Instruction() Instruction {
+	switch st.typ() {
+	case Stack_Push_Register:
+		return Instruction{op: "push", operands: []Operand{registerOperand(st.reg(), 1)}}
+	case Stack_Pop_Register:
+		return Instruction{op: "pop", operands: []Operand{registerOperand(st.reg(), 1)}}
+	case Stack_Push_Segment:
+		return Instruction{op: "push", operands: []Operand{segmentOperand(st.reg())}}
+	case Stack_Pop_Segment:
+		return Instruction{op: "pop", operands: []Operand{segmentOperand(st.reg())}}
+	case Stack_Pushf:
+		return Instruction{op: "pushf"}
+	}
+
+	return Instruction{op: "popf"}
+}
+func (st *Stack) Disassemble() string {
+	return NASM.Format(st.Instruction())
+}
+
+// in/out with a fixed port or the port in dx
+type InOut struct {
+	op   uint8
+	port uint8
+}
+
+func (io *InOut) isOut() bool {
+	return (io.op>>1)&1 == 1
+}
+
+// port in dx
+func (io *InOut) isVariable() bool {
+	return (io.op>>3)&1 == 1
+}
+
+func (io *InOut) wide() byte {
+	return io.op & 1
+}
+
+func (io *InOut) Instruction() Instruction {
+	acc := registerOperand(0, io.wide())
+
+	port := immediateOperand(uint16(io.port), 0)
+	if io.isVariable() {
+		port = registerOperand(2, 1)
+	}
+
+	if io.isOut() {
+		return Instruction{op: "out", operands: []Operand{port, acc}}
+	}
+	return Instruction{op: "in", operands: []Operand{acc, port}}
+}
+func (io *InOut) Disassemble() string {
+	return NASM.Format(io.Instruction())
+}
+
+// processor control without operands
+type Control struct {
+	op uint8
+}
+
+const (
+	Control_Cli uint8 = 0b11111010
+	Control_Sti uint8 = 0b11111011
+	Control_Hlt uint8 = 0b11110100
+)
+
+var Control_Names = map[uint8]string{
+	Control_Cli: "cli",
+	Control_Sti: "sti",
+	Control_Hlt: "hlt",
+}
+
+func (c *Control) Instruction() Instruction {
+	return Instruction{op: Control_Names[c.op]}
+}
+func (c *Control) Disassemble() string {
+	return NASM.Format(c.Instruction())
+}
+
 func getArithmeticOp(b byte) ArithmeticOp {
 	switch true {
 	case isAdd(b):
@@ -229,53 +446,52 @@ func (a *Arithmetic) opName() string {
 	panic("unreachable")
 }
 
-func (a *Arithmetic) Disassemble() string {
-	op := a.opName()
+func (a *Arithmetic) Instruction() Instruction {
+	result := Instruction{op: a.opName()}
 
 	switch a.typ {
 	case Arithmetic_RegOrMemory_With_Register_To_Either:
 		{
-			source := a.regName(a.w)
-			target := a.rmName(a.w)
+			source := registerOperand(a.reg, a.w)
+			target := a.rmOperand(a.w)
 
 			if a.d == 1 {
-				t := source
-				source = target
-				target = t
+				source, target = target, source
 			}
 
-			return fmt.Sprintf("%s %s, %s", op, target, source)
+			result.operands = []Operand{target, source}
 		}
 	case Arithmetic_Immediate_To_RegisterOrMemory:
 		{
-			// register
-			if a.mod == 0b11 {
-				return fmt.Sprintf("%s %s, %d", op, a.rmName(a.w), a.data)
-			}
+			target := a.rmOperand(a.w)
 
-			dataType := "byte"
-			if a.w == 1 {
-				dataType = "word"
+			// memory needs an explicit size
+			if a.mod != 0b11 {
+				target.sized = true
 			}
 
-			return fmt.Sprintf("%s %s %s, %d", op, dataType, a.rmName(a.w), a.data)
+			result.operands = []Operand{target, immediateOperand(a.data, a.w)}
 		}
-
 	case Arithmetic_Immediate_To_Accumulator:
 		{
-			regName := "ax"
-			if a.w == 0 {
-				regName = "al"
-			}
-			return fmt.Sprintf("%s %s, %d", op, regName, a.data)
+			result.operands = []Operand{registerOperand(0, a.w), immediateOperand(a.data, a.w)}
 		}
+	default:
+		panic("unreachable")
 	}
 
-	panic("unreachable")
+	return result
+}
+func (a *Arithmetic) Disassemble() string {
+	return NASM.Format(a.Instruction())
 }
 
 var REGISTERS_8 = []string{"al", "cl", "dl", "bl", "ah", "ch", "dh", "bh"}
 var REGISTERS_16 = []string{"ax", "cx", "dx", "bx", "sp", "bp", "si", "di"}
+var SEGMENT_REGISTERS = []string{"es", "cs", "ss", "ds"}
+
+// base and index registers indexed by the r/m field
+var EFFECTIVE_ADDRESSES = []string{"bx + si", "bx + di", "bp + si", "bp + di", "si", "di", "bp", "bx"}
 
 func regName(idx byte, wide byte) string {
 	regNames := REGISTERS_16
@@ -289,6 +505,13 @@ func regName(idx byte, wide byte) string {
 func (c *Common) regName(wide byte) string {
 	return regName(c.reg, wide)
 }
+func (c *Common) rmOperand(wide byte) Operand {
+	if c.mod == 0b11 {
+		return registerOperand(c.rm, wide)
+	}
+
+	return Operand{typ: Operand_Memory, wide: wide, mem: *c}
+}
 func (c *Common) rmName(wide byte) string {
 	switch c.mod {
 	case 0b11:
@@ -307,7 +530,7 @@ func (c *Common) rmName(wide byte) string {
 		fallthrough
 	case 0b10:
 		{
-			base := []string{"bx + si", "bx + di", "bp + si", "bp + di", "si", "di", "bp", "bx"}[c.rm]
+			base := EFFECTIVE_ADDRESSES[c.rm]
 
 			if c.mod == 0b00 {
 				if c.rm == 0b110 {
@@ -317,7 +540,7 @@ func (c *Common) rmName(wide byte) string {
 			}
 
 			if c.disp < 0 {
-				return fmt.Sprintf("[%s - %d]", base, -c.disp)
+				return fmt.Sprintf("[%s - %d]", base, -int(c.disp))
 			}
 
 			if c.disp == 0 {
@@ -331,50 +554,60 @@ func (c *Common) rmName(wide byte) string {
 	panic("unreachable")
 }
 
-func (m *Mov) Disassemble() string {
+func (m *Mov) Instruction() Instruction {
+	result := Instruction{op: "mov"}
+
 	switch m.typ {
 	case Mov_RegisteryOrMemory_ToOrFrom_Register:
 		{
-			source := m.regName(m.w)
-			target := m.rmName(m.w)
+			source := registerOperand(m.reg, m.w)
+			target := m.rmOperand(m.w)
 
 			if m.d == 1 {
-				t := source
-				source = target
-				target = t
+				source, target = target, source
 			}
 
-			return fmt.Sprintf("mov %s, %s", target, source)
-
+			result.operands = []Operand{target, source}
 		}
 	case Mov_Immediate_To_Register:
 		{
-			return fmt.Sprintf("mov %s, %d", m.regName(m.w), m.data)
+			result.operands = []Operand{registerOperand(m.reg, m.w), immediateOperand(m.data, m.w)}
 		}
 	case Mov_Immediate_To_RegisterOrMemory:
 		{
-			// register
-			if m.mod == 0b11 {
-				return fmt.Sprintf("mov %s, %d", m.rmName(m.w), m.data)
-			}
+			source := immediateOperand(m.data, m.w)
 
-			dataType := "byte"
-			if m.w == 1 {
-				dataType = "word"
+			// memory needs an explicit size
+			if m.mod != 0b11 {
+				source.sized = true
 			}
-			return fmt.Sprintf("mov %s, %s %d", m.rmName(m.w), dataType, m.data)
+
+			result.operands = []Operand{m.rmOperand(m.w), source}
 		}
 	case Mov_Memory_To_Accumulator:
 		{
-			return fmt.Sprintf("mov ax, [%d]", m.data)
+			result.operands = []Operand{registerOperand(0, m.w), directOperand(m.data, m.w)}
 		}
 	case Mov_Accumulator_To_Memory:
 		{
-			return fmt.Sprintf("mov [%d], ax", m.data)
+			result.operands = []Operand{directOperand(m.data, m.w), registerOperand(0, m.w)}
+		}
+	case Mov_RegisterOrMemory_To_Segment:
+		{
+			result.operands = []Operand{segmentOperand(m.reg & 0b11), m.rmOperand(1)}
 		}
+	case Mov_Segment_To_RegisterOrMemory:
+		{
+			result.operands = []Operand{m.rmOperand(1), segmentOperand(m.reg & 0b11)}
+		}
+	default:
+		panic("unreachable")
 	}
 
-	panic("unreachable")
+	return result
+}
+func (m *Mov) Disassemble() string {
+	return NASM.Format(m.Instruction())
 }
 
 // 100010dw
@@ -413,14 +646,30 @@ func parseMov(r *Reader) Mov {
 	case (firstByte >> 1) == 0b1010000:
 		{
 			result.typ = Mov_Memory_To_Accumulator
+			result.w = firstByte & 1
 			result.data = r.mustReadUint16()
 		}
-	// memory to accumulator
+	// accumulator to memory
 	case (firstByte >> 1) == 0b1010001:
 		{
 			result.typ = Mov_Accumulator_To_Memory
+			result.w = firstByte & 1
 			result.data = r.mustReadUint16()
 		}
+	// register/memory to segment register
+	case firstByte == 0b10001110:
+		{
+			result.typ = Mov_RegisterOrMemory_To_Segment
+			result.w = 1
+			result.Common = parseCommon(r)
+		}
+	// segment register to register/memory
+	case firstByte == 0b10001100:
+		{
+			result.typ = Mov_Segment_To_RegisterOrMemory
+			result.w = 1
+			result.Common = parseCommon(r)
+		}
 	}
 
 	return result
@@ -440,6 +689,11 @@ func parseArithmetic(r *Reader) Arithmetic {
 			result.Common = parseCommon(r)
 			result.data = r.mustReadUint16W(result.s == 0 && result.w == 1)
 
+			// sign extend
+			if result.s == 1 && result.w == 1 {
+				result.data = uint16(int16(int8(result.data)))
+			}
+
 			switch result.reg {
 			case 0b000:
 				result.op = Arithmetic_Add
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// expressions of conditional breakpoints and watchpoints, e.g.
+// `cx == 0 && flags.Z` or `word [es:di] != 0x1234`
+//
+// Operands are numbers, registers, `flags.Z`, `flags.S`, `flags.I` and
+// memory as `byte [addr]` or `word [addr]`, where addr is `[seg:]offset`
+// and seg defaults to ds. Operators by precedence, lowest first:
+//
+//	||
+//	&&
+//	== != < <= > >=
+//	+ - & | ^
+//	! - (unary)
+//
+// A condition holds when it evaluates to non-zero.
+
+type Expr func(s *Sim) int
+
+func parseExpr(str string) (Expr, error) {
+	tokens, err := tokenizeExpr(str)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	result, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.idx < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s in expression", p.tokens[p.idx])
+	}
+
+	return result, nil
+}
+
+// longest first
+var exprOperators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "+", "-", "&", "|", "^", "!", "(", ")", "[", "]", ":"}
+
+func tokenizeExpr(str string) ([]string, error) {
+	var result []string
+
+	for i := 0; i < len(str); {
+		c := str[i]
+
+		if c == ' ' || c == '\t' {
+			i += 1
+			continue
+		}
+
+		// numbers, registers and `flags.Z`
+		if isExprWordChar(c) {
+			j := i
+			for j < len(str) && (isExprWordChar(str[j]) || str[j] == '.') {
+				j += 1
+			}
+			result = append(result, str[i:j])
+			i = j
+			continue
+		}
+
+		found := false
+		for _, op := range exprOperators {
+			if strings.HasPrefix(str[i:], op) {
+				result = append(result, op)
+				i += len(op)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("unexpected %c in expression", c)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	return result, nil
+}
+
+func isExprWordChar(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+type exprParser struct {
+	tokens []string
+	idx    int
+}
+
+func (p *exprParser) peek() string {
+	if p.idx < len(p.tokens) {
+		return p.tokens[p.idx]
+	}
+	return ""
+}
+
+func (p *exprParser) expect(token string) error {
+	if p.peek() != token {
+		return fmt.Errorf("expected %s in expression", token)
+	}
+	p.idx += 1
+	return nil
+}
+
+func boolInt(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+func (p *exprParser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "||" {
+		p.idx += 1
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(s *Sim) int { return boolInt(l(s) != 0 || right(s) != 0) }
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (Expr, error) {
+	left, err := p.parseCompare()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "&&" {
+		p.idx += 1
+
+		right, err := p.parseCompare()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(s *Sim) int { return boolInt(l(s) != 0 && right(s) != 0) }
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseCompare() (Expr, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.peek()
+
+	var compare func(a, b int) bool
+
+	switch op {
+	case "==":
+		compare = func(a, b int) bool { return a == b }
+	case "!=":
+		compare = func(a, b int) bool { return a != b }
+	case "<":
+		compare = func(a, b int) bool { return a < b }
+	case "<=":
+		compare = func(a, b int) bool { return a <= b }
+	case ">":
+		compare = func(a, b int) bool { return a > b }
+	case ">=":
+		compare = func(a, b int) bool { return a >= b }
+	default:
+		return left, nil
+	}
+
+	p.idx += 1
+
+	right, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(s *Sim) int { return boolInt(compare(left(s), right(s))) }, nil
+}
+
+func (p *exprParser) parseSum() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var apply func(a, b int) int
+
+		switch p.peek() {
+		case "+":
+			apply = func(a, b int) int { return a + b }
+		case "-":
+			apply = func(a, b int) int { return a - b }
+		case "&":
+			apply = func(a, b int) int { return a & b }
+		case "|":
+			apply = func(a, b int) int { return a | b }
+		case "^":
+			apply = func(a, b int) int { return a ^ b }
+		default:
+			return left, nil
+		}
+
+		p.idx += 1
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(s *Sim) int { return apply(l(s), right(s)) }
+	}
+}
+
+func (p *exprParser) parseUnary() (Expr, error) {
+	switch p.peek() {
+	case "!":
+		{
+			p.idx += 1
+			operand, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return func(s *Sim) int { return boolInt(operand(s) == 0) }, nil
+		}
+	case "-":
+		{
+			p.idx += 1
+			operand, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return func(s *Sim) int { return -operand(s) }, nil
+		}
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (Expr, error) {
+	token := p.peek()
+	if token == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.idx += 1
+
+	if token == "(" {
+		result, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return result, p.expect(")")
+	}
+
+	lower := strings.ToLower(token)
+
+	switch true {
+	case lower == "byte" || lower == "word":
+		return p.parseMemory(lower == "word")
+	case lower == "flags.z" || lower == "zf":
+		return func(s *Sim) int { return boolInt(s.flags.zero) }, nil
+	case lower == "flags.s" || lower == "sf":
+		return func(s *Sim) int { return boolInt(s.flags.sign) }, nil
+	case lower == "flags.i" || lower == "if":
+		return func(s *Sim) int { return boolInt(s.flags.interrupt) }, nil
+	}
+
+	if v, err := parseNumber(token); err == nil {
+		return func(s *Sim) int { return v }, nil
+	}
+
+	if isRegister(lower) {
+		return func(s *Sim) int {
+			v, _ := s.getRegister(lower)
+			return int(v)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown %s in expression", token)
+}
+
+// after `byte` or `word`: `[offset]` or `[seg:offset]`
+func (p *exprParser) parseMemory(wide bool) (Expr, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+
+	offset, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	// ds
+	seg := func(s *Sim) int { return int(s.sregs[3]) }
+
+	if p.peek() == ":" {
+		p.idx += 1
+		seg = offset
+
+		offset, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+
+	var w byte
+	if wide {
+		w = 1
+	}
+
+	return func(s *Sim) int {
+		addr := int(uint16(seg(s)))<<4 + int(uint16(offset(s)))
+		return int(s.peekMem(addr%memSize, w))
+	}, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type OperandType int
+
+const (
+	Operand_Register OperandType = iota
+	Operand_Memory
+	Operand_Immediate
+	// jump target relative to the start of the instruction, `$+2` in NASM
+	Operand_Relative
+	Operand_SegmentRegister
+)
+
+type Operand struct {
+	typ  OperandType
+	wide byte
+
+	// register index, for Operand_Register and Operand_SegmentRegister
+	reg byte
+	// for Operand_Memory, direct address is mod=00, rm=110
+	mem Common
+	// for Operand_Immediate
+	imm uint16
+	// for Operand_Relative
+	rel int
+
+	// needs an explicit size, e.g. `word [bx]` or `word 5`
+	sized bool
+}
+
+func registerOperand(reg byte, wide byte) Operand {
+	return Operand{typ: Operand_Register, wide: wide, reg: reg}
+}
+func segmentOperand(sr byte) Operand {
+	return Operand{typ: Operand_SegmentRegister, wide: 1, reg: sr}
+}
+func immediateOperand(imm uint16, wide byte) Operand {
+	return Operand{typ: Operand_Immediate, wide: wide, imm: imm}
+}
+func directOperand(addr uint16, wide byte) Operand {
+	return Operand{typ: Operand_Memory, wide: wide, mem: Common{mod: 0b00, rm: 0b110, disp: int16(addr)}}
+}
+func relativeOperand(rel int) Operand {
+	return Operand{typ: Operand_Relative, rel: rel}
+}
+
+func (o *Operand) isDirect() bool {
+	return o.typ == Operand_Memory && o.mem.mod == 0b00 && o.mem.rm == 0b110
+}
+
+// base and index registers for the r/m field, e.g. `bx + si`
+func (o *Operand) memBase() string {
+	return EFFECTIVE_ADDRESSES[o.mem.rm]
+}
+
+// mnemonic and operands in intel order (destination first)
+type Instruction struct {
+	op       string
+	operands []Operand
+}
+
+// whether any operand carries an explicit size
+func (ins *Instruction) sized() bool {
+	for _, o := range ins.operands {
+		if o.sized {
+			return true
+		}
+	}
+	return false
+}
+
+// width of the instruction, 1 means word, -1 means no operand has a width
+func (ins *Instruction) wide() int {
+	for _, o := range ins.operands {
+		if o.typ != Operand_Relative {
+			return int(o.wide)
+		}
+	}
+	return -1
+}
+
+type Formatter interface {
+	Format(ins Instruction) string
+	// directive at the top of the output, e.g. `bits 16`
+	Header() string
+	// line comment prefix
+	Comment() string
+}
+
+type nasmFormatter struct{}
+type masmFormatter struct{}
+type attFormatter struct{}
+
+var NASM Formatter = nasmFormatter{}
+var MASM Formatter = masmFormatter{}
+var ATT Formatter = attFormatter{}
+
+func getFormatter(syntax string) (Formatter, error) {
+	switch syntax {
+	case "nasm":
+		return NASM, nil
+	case "masm", "tasm":
+		return MASM, nil
+	case "att", "gas":
+		return ATT, nil
+	}
+
+	return nil, fmt.Errorf("unknown syntax: %s", syntax)
+}
+
+func sizeName(wide byte) string {
+	if wide == 1 {
+		return "word"
+	}
+	return "byte"
+}
+
+func joinOperands(op string, operands []string) string {
+	if len(operands) == 0 {
+		return op
+	}
+	return fmt.Sprintf("%s %s", op, strings.Join(operands, ", "))
+}
+
+func (nasmFormatter) Header() string  { return "bits 16" }
+func (nasmFormatter) Comment() string { return ";" }
+func (masmFormatter) Header() string  { return ".8086" }
+func (masmFormatter) Comment() string { return ";" }
+func (attFormatter) Header() string   { return ".code16" }
+func (attFormatter) Comment() string  { return "#" }
+
+// e.g. `mov word [bp + si + 4], 5`, `jnz $-6`
+func (nasmFormatter) Format(ins Instruction) string {
+	operands := make([]string, len(ins.operands))
+
+	for idx, o := range ins.operands {
+		var str string
+
+		switch o.typ {
+		case Operand_Register:
+			str = regName(o.reg, o.wide)
+		case Operand_SegmentRegister:
+			str = SEGMENT_REGISTERS[o.reg]
+		case Operand_Memory:
+			str = o.mem.rmName(o.wide)
+		case Operand_Immediate:
+			str = fmt.Sprintf("%d", o.imm)
+		case Operand_Relative:
+			str = fmt.Sprintf("$%+d", o.rel)
+		}
+
+		if o.sized {
+			str = fmt.Sprintf("%s %s", sizeName(o.wide), str)
+		}
+
+		operands[idx] = str
+	}
+
+	return joinOperands(ins.op, operands)
+}
+
+// e.g. `mov word ptr [bp + si + 4], 5`, `mov ax, ds:[1000]`
+//
+// The size always goes to the memory operand and direct addresses need an
+// explicit segment, otherwise MASM treats `[1000]` as an immediate. We never
+// emit symbols, so there is nothing to mark with `OFFSET`.
+func (masmFormatter) Format(ins Instruction) string {
+	sized := ins.sized()
+	operands := make([]string, len(ins.operands))
+
+	for idx, o := range ins.operands {
+		var str string
+
+		switch o.typ {
+		case Operand_Register:
+			str = regName(o.reg, o.wide)
+		case Operand_SegmentRegister:
+			str = SEGMENT_REGISTERS[o.reg]
+		case Operand_Memory:
+			{
+				if o.isDirect() {
+					str = fmt.Sprintf("ds:[%d]", uint16(o.mem.disp))
+				} else {
+					str = o.mem.rmName(o.wide)
+				}
+
+				if sized {
+					str = fmt.Sprintf("%s ptr %s", sizeName(o.wide), str)
+				}
+			}
+		case Operand_Immediate:
+			str = fmt.Sprintf("%d", o.imm)
+		case Operand_Relative:
+			str = fmt.Sprintf("$%+d", o.rel)
+		}
+
+		operands[idx] = str
+	}
+
+	return joinOperands(ins.op, operands)
+}
+
+// e.g. `movw $5, 4(%bp,%si)`, `jnz .-6`
+//
+// Operands are reversed (source first) and the size goes to the mnemonic.
+func (attFormatter) Format(ins Instruction) string {
+	op := ins.op
+	wide := ins.wide()
+
+	switch op {
+	// the vector is not an operand size, e.g. `int $16`
+	case "int":
+		wide = -1
+	// the port isn't either, e.g. `outb %al, (%dx)`
+	case "in":
+		wide = int(ins.operands[0].wide)
+	case "out":
+		wide = int(ins.operands[1].wide)
+	}
+
+	switch wide {
+	case 0:
+		op += "b"
+	case 1:
+		op += "w"
+	}
+
+	operands := make([]string, len(ins.operands))
+
+	for idx, o := range ins.operands {
+		var str string
+
+		switch o.typ {
+		case Operand_Register:
+			{
+				str = "%" + regName(o.reg, o.wide)
+
+				// port in dx
+				if (ins.op == "in" || ins.op == "out") && o.reg == 2 && o.wide == 1 {
+					str = "(%dx)"
+				}
+			}
+		case Operand_SegmentRegister:
+			str = "%" + SEGMENT_REGISTERS[o.reg]
+		case Operand_Memory:
+			{
+				if o.isDirect() {
+					str = fmt.Sprintf("%d", uint16(o.mem.disp))
+					break
+				}
+
+				regs := strings.Split(o.memBase(), " + ")
+				for i := range regs {
+					regs[i] = "%" + regs[i]
+				}
+
+				str = fmt.Sprintf("(%s)", strings.Join(regs, ","))
+
+				if o.mem.disp != 0 {
+					str = fmt.Sprintf("%d%s", o.mem.disp, str)
+				}
+			}
+		case Operand_Immediate:
+			str = fmt.Sprintf("$%d", o.imm)
+		case Operand_Relative:
+			str = fmt.Sprintf(".%+d", o.rel)
+		}
+
+		operands[len(operands)-1-idx] = str
+	}
+
+	return joinOperands(op, operands)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+)
+
+// cross check the decoder against the builtin assembler
+//
+// Two properties are checked:
+//
+//  1. every encoding the decoder accepts (each first byte and mod reg r/m
+//     byte, with random displacement and immediate bytes) decodes to text
+//     that assembles to an instruction decoding to the same text. The
+//     assembler may pick a shorter encoding, e.g. `d=1` for register to
+//     register or `s=1` for small immediates, so bytes can differ here.
+//  2. random instruction text assembles to bytes whose disassembly
+//     assembles to the exact same bytes.
+
+type fuzzResult struct {
+	cases    int
+	failures int
+}
+
+func (f *fuzzResult) fail(msg string, args ...any) {
+	f.failures += 1
+
+	// the first ones are enough to debug
+	if f.failures <= 20 {
+		fmt.Printf("FAIL %s\n", fmt.Sprintf(msg, args...))
+	}
+}
+
+// panics of the decoder and assembler are reported as a failure too
+func (f *fuzzResult) check(property func() error) {
+	f.cases += 1
+
+	err := func() (err error) {
+		defer func() {
+			if e := recover(); e != nil {
+				err = fmt.Errorf("panic: %v", e)
+			}
+		}()
+		return property()
+	}()
+
+	if err != nil {
+		f.fail("%v", err)
+	}
+}
+
+// return false if any case fails
+func runFuzz(n int, seed int64) bool {
+	rng := rand.New(rand.NewSource(seed))
+
+	exhaustive := &fuzzResult{}
+	forEachEncoding(rng, func(buf []byte) {
+		exhaustive.check(func() error { return checkEncoding(buf) })
+	})
+
+	fmt.Printf("encodings: %d cases, %d failures\n", exhaustive.cases, exhaustive.failures)
+
+	random := &fuzzResult{}
+	for i := 0; i < n; i++ {
+		text := NASM.Format(randomInstruction(rng))
+		random.check(func() error { return checkText(text) })
+	}
+
+	fmt.Printf("instructions: %d cases, %d failures (seed %d)\n", random.cases, random.failures, seed)
+
+	return exhaustive.failures == 0 && random.failures == 0
+}
+
+// each first byte and mod reg r/m byte the decoder accepts, with random
+// displacement and immediate bytes
+func forEachEncoding(rng *rand.Rand, fn func(buf []byte)) {
+	for b0 := 0; b0 < 256; b0++ {
+		for modrm := 0; modrm < 256; modrm++ {
+			buf := []byte{byte(b0), byte(modrm), 0, 0, 0, 0}
+			rng.Read(buf[2:])
+
+			if validEncoding(buf[0], buf[1]) {
+				fn(buf)
+			}
+		}
+	}
+}
+
+// whether the decoder supports the instruction starting with these two bytes
+func validEncoding(b0, modrm byte) bool {
+	reg := (modrm >> 3) & 0b111
+
+	switch true {
+	// immediate to register/memory
+	case b0>>2 == 0b100000:
+		return reg == 0b000 || reg == 0b101 || reg == 0b111
+	case b0>>1 == 0b1100011:
+		return reg == 0b000
+	// cs can not be the destination
+	case b0 == 0b10001110:
+		return reg < 4 && reg != 1
+	case b0 == 0b10001100:
+		return reg < 4
+	}
+
+	return isMov(b0) || isArithmetic(b0) || isJumpOrLoop(b0) || isInterrupt(b0) ||
+		isStack(b0) || isInOut(b0) || isControl(b0)
+}
+
+// decode one instruction, panics of the decoder are returned as error
+func decodeOne(buf []byte) (cmd Command, size int, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("panic: %v", e)
+		}
+	}()
+
+	r := newReader(buf)
+	cmd, err = decodeCommand(r)
+	return cmd, r.idx, err
+}
+
+func decodeBytes(buf []byte) (Command, int, error) {
+	r := newReader(buf)
+	cmd, err := decodeCommand(r)
+	return cmd, r.idx, err
+}
+
+// property 1, buf has room for the longest instruction
+func checkEncoding(buf []byte) error {
+	cmd, size, err := decodeBytes(buf)
+	if err != nil {
+		return fmt.Errorf("% X: decode: %v", buf, err)
+	}
+
+	text := cmd.Disassemble()
+	a := &assembler{final: true}
+	code, err := a.assembleLine(text)
+	if err != nil {
+		return fmt.Errorf("% X: `%s`: assemble: %v", buf[:size], text, err)
+	}
+
+	cmd2, size2, err := decodeBytes(append(code, make([]byte, maxInsSize)...))
+	if err != nil {
+		return fmt.Errorf("% X: `%s` -> % X: decode: %v", buf[:size], text, code, err)
+	}
+
+	if size2 != len(code) || cmd2.Disassemble() != text {
+		return fmt.Errorf("% X: `%s` -> % X: `%s`", buf[:size], text, code, cmd2.Disassemble())
+	}
+
+	return nil
+}
+
+// property 2, the decoded bytes are padded like in memory, so reading
+// past the assembled instruction shows up as a size mismatch
+func checkText(text string) error {
+	a := &assembler{final: true}
+	code, err := a.assembleLine(text)
+	if err != nil {
+		return fmt.Errorf("`%s`: assemble: %v", text, err)
+	}
+
+	cmd, size, err := decodeBytes(append(code, make([]byte, maxInsSize)...))
+	if err != nil {
+		return fmt.Errorf("`%s` -> % X: decode: %v", text, code, err)
+	}
+
+	text2 := cmd.Disassemble()
+	code2, err := a.assembleLine(text2)
+	if err != nil {
+		return fmt.Errorf("`%s` -> % X: `%s`: assemble: %v", text, code, text2, err)
+	}
+
+	if size != len(code) || !bytes.Equal(code, code2) {
+		return fmt.Errorf("`%s` -> % X: `%s` -> % X", text, code, text2, code2)
+	}
+
+	return nil
+}
+
+func randomInstruction(rng *rand.Rand) Instruction {
+	w := byte(rng.Intn(2))
+	reg := func() Operand { return registerOperand(byte(rng.Intn(8)), w) }
+	mem := func() Operand { return Operand{typ: Operand_Memory, wide: w, mem: randomMemory(rng)} }
+	imm := func() Operand { return immediateOperand(randomImmediate(rng, w), w) }
+
+	switch rng.Intn(8) {
+	// mov
+	case 0:
+		{
+			result := Instruction{op: "mov"}
+
+			switch rng.Intn(7) {
+			case 0:
+				result.operands = []Operand{reg(), reg()}
+			case 1:
+				result.operands = []Operand{reg(), mem()}
+			case 2:
+				result.operands = []Operand{mem(), reg()}
+			case 3:
+				result.operands = []Operand{reg(), imm()}
+			case 4:
+				{
+					source := imm()
+					source.sized = true
+					result.operands = []Operand{mem(), source}
+				}
+			case 5:
+				{
+					sr := segmentOperand(byte(rng.Intn(4)))
+					other := registerOperand(byte(rng.Intn(8)), 1)
+					if rng.Intn(2) == 0 {
+						other = Operand{typ: Operand_Memory, wide: 1, mem: randomMemory(rng)}
+					}
+
+					result.operands = []Operand{other, sr}
+					if sr.reg != 1 && rng.Intn(2) == 0 {
+						result.operands = []Operand{sr, other}
+					}
+				}
+			case 6:
+				{
+					acc := registerOperand(0, w)
+					addr := directOperand(uint16(rng.Intn(0x10000)), w)
+					result.operands = []Operand{acc, addr}
+					if rng.Intn(2) == 0 {
+						result.operands = []Operand{addr, acc}
+					}
+				}
+			}
+
+			return result
+		}
+	// add, sub, cmp
+	case 1, 2:
+		{
+			result := Instruction{op: []string{"add", "sub", "cmp"}[rng.Intn(3)]}
+
+			switch rng.Intn(5) {
+			case 0:
+				result.operands = []Operand{reg(), reg()}
+			case 1:
+				result.operands = []Operand{reg(), mem()}
+			case 2:
+				result.operands = []Operand{mem(), reg()}
+			case 3:
+				result.operands = []Operand{reg(), imm()}
+			case 4:
+				{
+					target := mem()
+					target.sized = true
+					result.operands = []Operand{target, imm()}
+				}
+			}
+
+			return result
+		}
+	case 3:
+		{
+			if rng.Intn(4) == 0 {
+				return Instruction{op: "iret"}
+			}
+			return Instruction{op: "int", operands: []Operand{immediateOperand(uint16(rng.Intn(256)), 0)}}
+		}
+	// push, pop, pushf, popf
+	case 4:
+		{
+			op := []string{"push", "pop"}[rng.Intn(2)]
+
+			switch rng.Intn(3) {
+			case 0:
+				return Instruction{op: op, operands: []Operand{registerOperand(byte(rng.Intn(8)), 1)}}
+			case 1:
+				{
+					sr := byte(rng.Intn(4))
+					// no `pop cs`
+					if op == "pop" && sr == 1 {
+						sr = 3
+					}
+					return Instruction{op: op, operands: []Operand{segmentOperand(sr)}}
+				}
+			}
+
+			return Instruction{op: op + "f"}
+		}
+	// in, out
+	case 5:
+		{
+			acc := registerOperand(0, w)
+			port := immediateOperand(uint16(rng.Intn(256)), 0)
+			if rng.Intn(2) == 0 {
+				port = registerOperand(2, 1)
+			}
+
+			if rng.Intn(2) == 0 {
+				return Instruction{op: "out", operands: []Operand{port, acc}}
+			}
+			return Instruction{op: "in", operands: []Operand{acc, port}}
+		}
+	case 6:
+		return Instruction{op: []string{"cli", "sti", "hlt"}[rng.Intn(3)]}
+	}
+
+	// jumps, from `$-126` to `$+129`
+	names := append(append([]string{}, Jump_Labels...), Loop_Lables...)
+	return Instruction{
+		op:       names[rng.Intn(len(names))],
+		operands: []Operand{relativeOperand(rng.Intn(256) - 128 + 2)},
+	}
+}
+
+// random effective address with the mod nasm would pick
+func randomMemory(rng *rand.Rand) Common {
+	rm := byte(rng.Intn(8))
+
+	// direct address
+	if rm == 0b110 && rng.Intn(2) == 0 {
+		return Common{mod: 0b00, rm: rm, disp: int16(rng.Intn(0x10000))}
+	}
+
+	switch rng.Intn(3) {
+	case 0:
+		if rm != 0b110 {
+			return Common{mod: 0b00, rm: rm}
+		}
+		return Common{mod: 0b01, rm: rm}
+	case 1:
+		return Common{mod: 0b01, rm: rm, disp: int16(rng.Intn(256) - 128)}
+	}
+
+	disp := int16(rng.Intn(0x10000))
+	for fitsInt8(int(disp)) {
+		disp = int16(rng.Intn(0x10000))
+	}
+
+	return Common{mod: 0b10, rm: rm, disp: disp}
+}
+
+// immediates as the decoder produces them, bytes are unsigned
+func randomImmediate(rng *rand.Rand, w byte) uint16 {
+	if w == 0 {
+		return uint16(rng.Intn(256))
+	}
+
+	// small ones hit the sign extended encoding
+	if rng.Intn(2) == 0 {
+		return uint16(int16(rng.Intn(256) - 128))
+	}
+
+	return uint16(rng.Intn(0x10000))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// property 1 over every encoding the decoder accepts
+func TestEncodings(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	failures := 0
+
+	forEachEncoding(rng, func(buf []byte) {
+		if err := checkEncoding(buf); err != nil && failures < 20 {
+			failures += 1
+			t.Error(err)
+		}
+	})
+}
+
+// property 2 over random instruction text
+func TestRandomInstructions(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 20000; i++ {
+		text := NASM.Format(randomInstruction(rng))
+		if err := checkText(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// property 1 over any bytes, run with `go test -fuzz FuzzRoundTrip`
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte{0x89, 0xd9})
+	f.Add([]byte{0x83, 0x06, 0xe8, 0x03, 0x01})
+	f.Add([]byte{0xc7, 0x86, 0x10, 0x00, 0x34, 0x12})
+	f.Add([]byte{0x75, 0xfa})
+	f.Add([]byte{0xcd, 0x10})
+	// `[bp - 32768]`, the displacement used to overflow when negated
+	f.Add([]byte{0x38, 0x96, 0x00, 0x80})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 2 || !validEncoding(data[0], data[1]) {
+			t.Skip()
+		}
+
+		buf := make([]byte, maxInsSize)
+		copy(buf, data)
+
+		if err := checkEncoding(buf); err != nil {
+			t.Error(err)
+		}
+	})
+}
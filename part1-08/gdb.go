@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// gdb remote serial protocol stub, `-gdb addr`
+//
+// gdb connects with
+//
+//	(gdb) set architecture i8086
+//	(gdb) target remote localhost:1234
+//
+// and sees the i386 register layout, 16 registers of 4 bytes each: eax,
+// ecx, edx, ebx, esp, ebp, esi, edi, eip, eflags, cs, ss, ds, es, fs, gs.
+// Memory addresses are physical addresses.
+
+// index of eip, eflags and the first segment register in the layout
+const (
+	gdbRegIP    = 8
+	gdbRegFlags = 9
+	gdbRegCS    = 10
+	gdbRegCount = 16
+)
+
+// largest packet we take and send, `m` replies are hex so half of it is
+// the most memory read at once
+const gdbPacketSize = 0x4000
+
+// instructions run between checks for a ctrl-c from gdb
+const gdbPollSteps = 1024
+
+// cs, ss, ds, es in gdb's order as index of `Sim.sregs`, fs and gs don't exist
+var gdbSegments = []int{1, 2, 3, 0}
+
+// packets from the reader goroutine, `\x03` is an interrupt
+type gdbPacket struct {
+	data string
+	err  error
+	// checksum mismatch, gdb sends it again, any other error ends the
+	// connection
+	corrupt bool
+}
+
+type GDBServer struct {
+	sim  *Sim
+	conn io.ReadWriter
+
+	packets chan gdbPacket
+	// received while running, served after stopping
+	pending []gdbPacket
+
+	breakpoints map[int]bool
+	noAck       bool
+}
+
+// listen on addr and serve one gdb connection
+func serveGDB(addr string, sim *Sim) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	fmt.Printf("gdb: listening on %s\n", listener.Addr())
+
+	conn, err := listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	fmt.Printf("gdb: connection from %s\n", conn.RemoteAddr())
+
+	server := newGDBServer(sim, conn)
+	go server.readPackets()
+
+	return server.serve()
+}
+
+func newGDBServer(sim *Sim, conn io.ReadWriter) *GDBServer {
+	return &GDBServer{
+		sim:         sim,
+		conn:        conn,
+		packets:     make(chan gdbPacket, 16),
+		breakpoints: map[int]bool{},
+	}
+}
+
+// `$data#checksum` packets and interrupts
+func (g *GDBServer) readPackets() {
+	r := bufio.NewReader(g.conn)
+
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			g.packets <- gdbPacket{err: err}
+			return
+		}
+
+		switch c {
+		case 0x03:
+			g.packets <- gdbPacket{data: "\x03"}
+		case '$':
+			{
+				data, err := r.ReadString('#')
+				if err != nil {
+					g.packets <- gdbPacket{err: err}
+					return
+				}
+				data = data[:len(data)-1]
+
+				var sum [2]byte
+				if _, err := io.ReadFull(r, sum[:]); err != nil {
+					g.packets <- gdbPacket{err: err}
+					return
+				}
+
+				if expected, err := strconv.ParseUint(string(sum[:]), 16, 8); err != nil || byte(expected) != gdbChecksum(data) {
+					g.packets <- gdbPacket{err: fmt.Errorf("checksum mismatch: %s", data), corrupt: true}
+					continue
+				}
+
+				g.packets <- gdbPacket{data: data}
+			}
+		}
+		// `+` and `-` acknowledges are ignored, tcp is reliable
+	}
+}
+
+func gdbChecksum(data string) byte {
+	var result byte
+	for i := 0; i < len(data); i++ {
+		result += data[i]
+	}
+	return result
+}
+
+func (g *GDBServer) send(data string) error {
+	_, err := fmt.Fprintf(g.conn, "$%s#%02x", data, gdbChecksum(data))
+	return err
+}
+
+func (g *GDBServer) serve() error {
+	for {
+		var p gdbPacket
+
+		if len(g.pending) > 0 {
+			p, g.pending = g.pending[0], g.pending[1:]
+		} else {
+			p = <-g.packets
+		}
+
+		if p.err == io.EOF {
+			return nil
+		}
+
+		if p.err != nil && !p.corrupt {
+			return p.err
+		}
+
+		if p.err != nil {
+			fmt.Printf("gdb: %v\n", p.err)
+			if !g.noAck {
+				g.conn.Write([]byte("-"))
+			}
+			continue
+		}
+
+		// interrupt while stopped
+		if p.data == "\x03" {
+			if err := g.send("S02"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !g.noAck {
+			if _, err := g.conn.Write([]byte("+")); err != nil {
+				return err
+			}
+		}
+
+		reply, quit, err := g.handle(p.data)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := g.send(reply); err != nil {
+			return err
+		}
+
+		if quit {
+			return nil
+		}
+	}
+}
+
+// reply of the packet, quit to close the connection, an error if the
+// connection ended while the program ran
+func (g *GDBServer) handle(data string) (string, bool, error) {
+	switch true {
+	case data == "?":
+		return "S05", false, nil
+	case data == "g":
+		return g.readRegisters(), false, nil
+	case strings.HasPrefix(data, "G"):
+		return g.writeRegisters(data[1:]), false, nil
+	case strings.HasPrefix(data, "p"):
+		return g.readRegister(data[1:]), false, nil
+	case strings.HasPrefix(data, "P"):
+		return g.writeRegister(data[1:]), false, nil
+	case strings.HasPrefix(data, "m"):
+		return g.readMemory(data[1:]), false, nil
+	case strings.HasPrefix(data, "M"):
+		return g.writeMemory(data[1:]), false, nil
+	case strings.HasPrefix(data, "s"):
+		return g.resume(data[1:], true)
+	case strings.HasPrefix(data, "c"):
+		return g.resume(data[1:], false)
+	case strings.HasPrefix(data, "Z0,") || strings.HasPrefix(data, "Z1,"):
+		return g.setBreakpoint(data[3:], true), false, nil
+	case strings.HasPrefix(data, "z0,") || strings.HasPrefix(data, "z1,"):
+		return g.setBreakpoint(data[3:], false), false, nil
+	case len(data) > 3 && (data[0] == 'Z' || data[0] == 'z') && data[1] >= '2' && data[1] <= '4' && data[2] == ',':
+		return g.setWatchpoint(data[1], data[3:], data[0] == 'Z'), false, nil
+	case strings.HasPrefix(data, "qSupported"):
+		return fmt.Sprintf("PacketSize=%x;QStartNoAckMode+", gdbPacketSize), false, nil
+	case data == "QStartNoAckMode":
+		{
+			g.noAck = true
+			return "OK", false, nil
+		}
+	case data == "qAttached":
+		return "1", false, nil
+	case data == "qC":
+		return "QC1", false, nil
+	case data == "qfThreadInfo":
+		return "m1", false, nil
+	case data == "qsThreadInfo":
+		return "l", false, nil
+	case strings.HasPrefix(data, "H"):
+		return "OK", false, nil
+	case data == "k":
+		return "OK", true, nil
+	case strings.HasPrefix(data, "D"):
+		return "OK", true, nil
+	}
+
+	// empty reply for unsupported packets
+	return "", false, nil
+}
+
+// little endian hex of a 4 byte register
+func gdbRegister(val uint32) string {
+	return fmt.Sprintf("%02x%02x%02x%02x", byte(val), byte(val>>8), byte(val>>16), byte(val>>24))
+}
+
+func parseGDBRegister(str string) (uint32, error) {
+	buf, err := hex.DecodeString(str)
+	if err != nil || len(buf) != 4 {
+		return 0, fmt.Errorf("invalid register value %s", str)
+	}
+
+	return uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16 | uint32(buf[3])<<24, nil
+}
+
+func (g *GDBServer) getRegister(idx int) uint32 {
+	s := g.sim
+
+	switch true {
+	case idx < gdbRegIP:
+		return uint32(s.regs[idx])
+	case idx == gdbRegIP:
+		return uint32(s.ip)
+	case idx == gdbRegFlags:
+		return uint32(s.flags.word())
+	case idx-gdbRegCS < len(gdbSegments):
+		return uint32(s.sregs[gdbSegments[idx-gdbRegCS]])
+	}
+
+	return 0
+}
+
+// false if eip is out of memory, it's a physical address
+func (g *GDBServer) setRegister(idx int, val uint32) bool {
+	s := g.sim
+
+	switch true {
+	case idx < gdbRegIP:
+		s.regs[idx] = uint16(val)
+	case idx == gdbRegIP:
+		{
+			if val >= memSize {
+				return false
+			}
+			s.ip = int(val)
+		}
+	case idx == gdbRegFlags:
+		s.flags.setWord(uint16(val))
+	case idx-gdbRegCS < len(gdbSegments):
+		s.sregs[gdbSegments[idx-gdbRegCS]] = uint16(val)
+	}
+
+	return true
+}
+
+func (g *GDBServer) readRegisters() string {
+	b := new(strings.Builder)
+
+	for idx := 0; idx < gdbRegCount; idx++ {
+		b.WriteString(gdbRegister(g.getRegister(idx)))
+	}
+
+	return b.String()
+}
+
+func (g *GDBServer) writeRegisters(data string) string {
+	if len(data) != gdbRegCount*8 {
+		return "E01"
+	}
+
+	var vals [gdbRegCount]uint32
+	for idx := range vals {
+		val, err := parseGDBRegister(data[idx*8 : idx*8+8])
+		if err != nil || (idx == gdbRegIP && val >= memSize) {
+			return "E01"
+		}
+		vals[idx] = val
+	}
+
+	for idx, val := range vals {
+		g.setRegister(idx, val)
+	}
+
+	return "OK"
+}
+
+// `p n`
+func (g *GDBServer) readRegister(data string) string {
+	idx, err := strconv.ParseUint(data, 16, 8)
+	if err != nil || idx >= gdbRegCount {
+		return "E01"
+	}
+
+	return gdbRegister(g.getRegister(int(idx)))
+}
+
+// `P n=value`
+func (g *GDBServer) writeRegister(data string) string {
+	idxStr, valStr, _ := strings.Cut(data, "=")
+
+	idx, err := strconv.ParseUint(idxStr, 16, 8)
+	if err != nil || idx >= gdbRegCount {
+		return "E01"
+	}
+
+	val, err := parseGDBRegister(valStr)
+	if err != nil {
+		return "E01"
+	}
+
+	if !g.setRegister(int(idx), val) {
+		return "E01"
+	}
+	return "OK"
+}
+
+// `addr,length` in hex
+func parseGDBRange(str string) (int, int, error) {
+	addrStr, lenStr, found := strings.Cut(str, ",")
+	if !found {
+		return 0, 0, errors.New("invalid range")
+	}
+
+	addr, err := strconv.ParseUint(addrStr, 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	length, err := strconv.ParseUint(lenStr, 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(addr), int(length), nil
+}
+
+// `m addr,length`, addresses wrap around at 1MB
+func (g *GDBServer) readMemory(data string) string {
+	addr, length, err := parseGDBRange(data)
+	if err != nil || length > gdbPacketSize/2 {
+		return "E01"
+	}
+
+	buf := make([]byte, length)
+	for i := range buf {
+		buf[i] = byte(g.sim.peekMem(addr+i, 0))
+	}
+
+	return hex.EncodeToString(buf)
+}
+
+// `M addr,length:bytes`
+func (g *GDBServer) writeMemory(data string) string {
+	rangeStr, bytesStr, _ := strings.Cut(data, ":")
+
+	addr, length, err := parseGDBRange(rangeStr)
+	if err != nil {
+		return "E01"
+	}
+
+	buf, err := hex.DecodeString(bytesStr)
+	if err != nil || len(buf) != length {
+		return "E01"
+	}
+
+	for i, b := range buf {
+		g.sim.pokeMem(addr+i, uint16(b), 0)
+	}
+
+	return "OK"
+}
+
+// `Z0,addr,kind` and `z0,addr,kind`
+func (g *GDBServer) setBreakpoint(data string, set bool) string {
+	addrStr, _, _ := strings.Cut(data, ",")
+
+	addr, err := strconv.ParseUint(addrStr, 16, 32)
+	if err != nil {
+		return "E01"
+	}
+
+	if set {
+		g.breakpoints[int(addr)] = true
+	} else {
+		delete(g.breakpoints, int(addr))
+	}
+
+	return "OK"
+}
+
+// `s [addr]` and `c [addr]`, reply with the stop reason, addr is physical
+// like ip in the registers
+func (g *GDBServer) resume(data string, single bool) (string, bool, error) {
+	if data != "" {
+		addr, err := strconv.ParseUint(data, 16, 32)
+		if err != nil || addr >= memSize {
+			return "E01", false, nil
+		}
+		g.sim.ip = int(addr)
+	}
+
+	for steps := 1; ; steps++ {
+		cmd, _, err := g.sim.step()
+
+		if err != nil {
+			fmt.Printf("gdb: %v\n", err)
+			// SIGILL
+			return "S04", false, nil
+		}
+
+		// exited with status 0
+		if cmd == nil {
+			return "W00", false, nil
+		}
+
+		if len(g.sim.watchHits) > 0 {
+			return g.watchStop(&g.sim.watchHits[0]), false, nil
+		}
+
+		if single || g.breakpoints[g.sim.ip] {
+			// SIGTRAP
+			return "S05", false, nil
+		}
+
+		if steps%gdbPollSteps != 0 {
+			continue
+		}
+
+		// ctrl-c from gdb
+		select {
+		case p := <-g.packets:
+			{
+				// the connection is gone
+				if p.err != nil && !p.corrupt {
+					return "", false, p.err
+				}
+
+				if p.data == "\x03" {
+					// SIGINT
+					return "S02", false, nil
+				}
+
+				// gdb doesn't send other packets while running
+				g.pending = append(g.pending, p)
+			}
+		default:
+		}
+	}
+}
+
+// Z2 write, Z3 read and Z4 access watchpoints
+var gdbWatchKinds = map[byte]WatchKind{
+	'2': Watch_Write,
+	'3': Watch_Read,
+	'4': Watch_Read | Watch_Write,
+}
+
+// `Z2,addr,length` and `z2,addr,length`
+func (g *GDBServer) setWatchpoint(typ byte, data string, set bool) string {
+	addr, length, err := parseGDBRange(data)
+	if err != nil || length <= 0 {
+		return "E01"
+	}
+
+	kind := gdbWatchKinds[typ]
+
+	if set {
+		g.sim.addWatchpoint(&Watchpoint{kind: kind, addr: addr, size: length, reg: -1})
+		return "OK"
+	}
+
+	for _, w := range g.sim.watchpoints {
+		if w.kind == kind && w.addr == addr && w.size == length {
+			g.sim.deleteWatchpoint(w.id)
+			return "OK"
+		}
+	}
+
+	return "E01"
+}
+
+// e.g. `T05watch:100;`
+func (g *GDBServer) watchStop(hit *WatchHit) string {
+	name := "awatch"
+
+	switch hit.wp.kind {
+	case Watch_Write:
+		name = "watch"
+	case Watch_Read:
+		name = "rwatch"
+	}
+
+	return fmt.Sprintf("T05%s:%x;", name, hit.addr)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type gdbClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	// serve returned
+	done chan error
+}
+
+func newGDBClient(t *testing.T, src string) *gdbClient {
+	client, conn := net.Pipe()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+
+	server := newGDBServer(newSim(assembleSource(t, src).code), conn)
+	done := make(chan error, 1)
+	go server.readPackets()
+	go func() {
+		done <- server.serve()
+		conn.Close()
+	}()
+
+	t.Cleanup(func() { client.Close() })
+
+	return &gdbClient{t: t, conn: client, r: bufio.NewReader(client), done: done}
+}
+
+func (c *gdbClient) write(data string) {
+	c.t.Helper()
+
+	if _, err := c.conn.Write([]byte(data)); err != nil {
+		c.t.Fatalf("write %q: %v", data, err)
+	}
+}
+
+// the packet is acknowledged
+func (c *gdbClient) send(data string) {
+	c.t.Helper()
+
+	c.write(fmt.Sprintf("$%s#%02x", data, gdbChecksum(data)))
+
+	if ack, err := c.r.ReadByte(); err != nil || ack != '+' {
+		c.t.Fatalf("%s: got ack %q, %v", data, ack, err)
+	}
+}
+
+func (c *gdbClient) reply() string {
+	c.t.Helper()
+
+	if _, err := c.r.ReadString('$'); err != nil {
+		c.t.Fatalf("read reply: %v", err)
+	}
+
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatalf("read reply: %v", err)
+	}
+	data = data[:len(data)-1]
+
+	var sum [2]byte
+	if _, err := io.ReadFull(c.r, sum[:]); err != nil {
+		c.t.Fatalf("read checksum: %v", err)
+	}
+	if string(sum[:]) != fmt.Sprintf("%02x", gdbChecksum(data)) {
+		c.t.Fatalf("checksum %s of %s", sum, data)
+	}
+
+	return data
+}
+
+func (c *gdbClient) expect(data string, want string) {
+	c.t.Helper()
+
+	c.send(data)
+	if got := c.reply(); got != want {
+		c.t.Fatalf("%s: got %q, want %q", data, got, want)
+	}
+}
+
+const gdbLoop = `bits 16
+mov cx, 3
+top:
+add word [1000], 1
+sub cx, 1
+jnz top
+`
+
+func TestGDBSession(t *testing.T) {
+	c := newGDBClient(t, gdbLoop)
+
+	c.expect("?", "S05")
+
+	c.send("g")
+	regs := c.reply()
+	if len(regs) != gdbRegCount*8 || regs[gdbRegIP*8:gdbRegIP*8+8] != "00000000" {
+		t.Fatalf("registers %s, want ip 0", regs)
+	}
+
+	c.expect("M3e8,2:3412", "OK")
+	c.expect("m3e8,2", "3412")
+
+	c.expect("s", "S05")
+	c.expect("p8", gdbRegister(3))
+	c.expect("p1", gdbRegister(3))
+
+	// `sub cx, 1`
+	c.expect("Z0,8,1", "OK")
+	c.expect("c", "S05")
+	c.expect("p8", gdbRegister(8))
+	c.expect("m3e8,2", "3512")
+
+	c.expect("c", "S05")
+	c.expect("p1", gdbRegister(2))
+
+	c.expect("z0,8,1", "OK")
+	c.expect("c", "W00")
+	c.expect("m3e8,2", "3712")
+
+	c.expect("k", "OK")
+	if err := <-c.done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+const gdbForever = `bits 16
+top:
+cmp ax, ax
+jz top
+`
+
+func TestGDBInterrupt(t *testing.T) {
+	c := newGDBClient(t, gdbForever)
+
+	c.send("c")
+	c.write("\x03")
+	if got := c.reply(); got != "S02" {
+		t.Fatalf("interrupted with %q, want S02", got)
+	}
+
+	c.expect("?", "S05")
+}
+
+// the program doesn't keep running when gdb goes away
+func TestGDBDisconnectWhileRunning(t *testing.T) {
+	c := newGDBClient(t, gdbForever)
+
+	c.send("c")
+	c.conn.Close()
+
+	// the closed connection ends the session, nothing is sent to it
+	select {
+	case err := <-c.done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still running after the connection closed")
+	}
+}
+
+// reads are limited by the packet size, ip is a physical address
+func TestGDBLimits(t *testing.T) {
+	c := newGDBClient(t, gdbLoop)
+
+	c.send("m0,2000")
+	if got := c.reply(); len(got) != gdbPacketSize {
+		t.Fatalf("read %d hex digits, want %d", len(got), gdbPacketSize)
+	}
+	c.expect("m0,2001", "E01")
+	c.expect("m0,ffffffff", "E01")
+
+	c.expect("P8=03000100", "OK")
+	c.expect("p8", "03000100")
+	c.expect("P8=00001000", "E01")
+	c.expect("c100000", "E01")
+	c.expect("p8", "03000100")
+
+	// past the end of the program, not cut to 0003
+	c.expect("s10003", "W00")
+}
+
+// packets other than interrupts sent while running are served afterwards
+func TestGDBPacketWhileRunning(t *testing.T) {
+	c := newGDBClient(t, gdbForever)
+
+	c.send("c")
+	c.write(fmt.Sprintf("$qC#%02x", gdbChecksum("qC")))
+	c.write("\x03")
+
+	var replies []string
+	for i := 0; i < 2; i++ {
+		replies = append(replies, c.reply())
+	}
+
+	if got := strings.Join(replies, " "); got != "S02 QC1" {
+		t.Fatalf("got %s, want S02 QC1", got)
+	}
+}
+
+// a deleted watchpoint doesn't stop the next continue
+func TestGDBDeleteWatchpointThenContinue(t *testing.T) {
+	c := newGDBClient(t, gdbLoop)
+
+	c.expect("Z2,3e8,2", "OK")
+	c.expect("c", "T05watch:3e8;")
+	c.expect("z2,3e8,2", "OK")
+	c.expect("c", "W00")
+	c.expect("m3e8,2", "0300")
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// regression runner over listing directories
+//
+// Every `listing_xxxx.txt` is the expected execution output of the listing
+// next to it, either `listing_xxxx.asm` or the assembled `listing_xxxx`.
+// Only register and flags changes are compared, ip and clocks are ignored
+// since older outputs don't have them.
+
+type goldenLine struct {
+	// 1-based line number in the golden file
+	line int
+	text string
+}
+
+type goldenListing struct {
+	trace []goldenLine
+	final []goldenLine
+}
+
+// return false if any listing diverges
+func runGolden(dirs []string) bool {
+	ok := true
+
+	for _, dir := range dirs {
+		files, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", dir, err)
+			ok = false
+			continue
+		}
+
+		if len(files) == 0 {
+			fmt.Printf("skip %s: no golden files\n", dir)
+		}
+
+		for _, file := range files {
+			name := strings.TrimSuffix(filepath.Base(file), ".txt")
+
+			if err := checkGolden(file); err != nil {
+				fmt.Printf("FAIL %s\n     %v\n", name, err)
+				ok = false
+			} else {
+				fmt.Printf("ok   %s\n", name)
+			}
+		}
+	}
+
+	return ok
+}
+
+func checkGolden(file string) error {
+	golden, err := parseGolden(file)
+	if err != nil {
+		return err
+	}
+
+	base := strings.TrimSuffix(file, ".txt")
+	listing := base + ".asm"
+	if _, err := os.Stat(listing); err != nil {
+		listing = base
+	}
+
+	buf, _, err := loadProgram(listing)
+	if err != nil {
+		return err
+	}
+
+	diverge := func(expected goldenLine, got string) error {
+		return fmt.Errorf("line %d:\n       expected: %s\n       got:      %s", expected.line, expected.text, got)
+	}
+
+	sim := newSim(buf)
+
+	for _, expected := range golden.trace {
+		cmd, delta, err := sim.step()
+		if err != nil {
+			return diverge(expected, fmt.Sprintf("error: %v", err))
+		}
+		if cmd == nil {
+			return diverge(expected, "<end of program>")
+		}
+
+		got := normalizeTraceLine(fmt.Sprintf("%s ; %s", cmd.Disassemble(), delta.String()))
+		if got != normalizeTraceLine(expected.text) {
+			return diverge(expected, got)
+		}
+	}
+
+	// more instructions than expected
+	if cmd, err := sim.disassemble(); err != nil || cmd != nil {
+		line := goldenLine{len(golden.trace) + 1, "<end of program>"}
+		if len(golden.final) > 0 {
+			line.line = golden.final[0].line - 1
+		}
+		if err != nil {
+			return diverge(line, fmt.Sprintf("error: %v", err))
+		}
+		return diverge(line, cmd.Disassemble())
+	}
+
+	got := finalRegisterLines(sim, golden)
+
+	for idx, expected := range golden.final {
+		if idx >= len(got) {
+			return diverge(expected, "<missing>")
+		}
+		if got[idx] != normalizeFinalLine(expected.text) {
+			return diverge(expected, got[idx])
+		}
+	}
+
+	if len(got) > len(golden.final) {
+		line := goldenLine{0, "<nothing>"}
+		if len(golden.final) > 0 {
+			line.line = golden.final[len(golden.final)-1].line + 1
+		}
+		return diverge(line, got[len(golden.final)])
+	}
+
+	return nil
+}
+
+func parseGolden(file string) (*goldenListing, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &goldenListing{}
+	inFinal := false
+
+	for idx, line := range strings.Split(string(b), "\n") {
+		text := strings.TrimSpace(line)
+
+		switch true {
+		case text == "" || strings.HasPrefix(text, "---"):
+			continue
+		case text == "Final registers:":
+			inFinal = true
+		case inFinal:
+			result.final = append(result.final, goldenLine{idx + 1, text})
+		default:
+			result.trace = append(result.trace, goldenLine{idx + 1, text})
+		}
+	}
+
+	if len(result.trace) == 0 {
+		return nil, fmt.Errorf("%s: no instructions", file)
+	}
+
+	return result, nil
+}
+
+// keep the instruction and its register and flags changes,
+// e.g. `mov ss, ax ; ss:0x0->0x2222`, the reference output has no memory
+// writes
+func normalizeTraceLine(line string) string {
+	text, changes, _ := strings.Cut(line, ";")
+
+	result := []string{strings.Join(strings.Fields(text), " "), ";"}
+
+	for _, token := range strings.Fields(changes) {
+		name, _, found := strings.Cut(token, ":")
+		if !found {
+			continue
+		}
+
+		if name == "flags" || indexOf(REGISTERS_16, name) >= 0 || indexOf(SEGMENT_REGISTERS, name) >= 0 {
+			result = append(result, token)
+		}
+	}
+
+	return strings.Join(result, " ")
+}
+
+func normalizeFinalLine(line string) string {
+	return strings.Join(strings.Fields(line), " ")
+}
+
+// our final registers in the golden format, ip and flags
+// are only included when the golden file has them
+func finalRegisterLines(sim *Sim, golden *goldenListing) []string {
+	hasIP := false
+	hasFlags := false
+
+	for _, line := range golden.final {
+		hasIP = hasIP || strings.HasPrefix(line.text, "ip:")
+		hasFlags = hasFlags || strings.HasPrefix(line.text, "flags:")
+	}
+
+	var result []string
+
+	for _, line := range strings.Split(sim.dumpRegs(), "\n") {
+		line = normalizeFinalLine(line)
+
+		if line == "" || line == "Final registers:" || (strings.HasPrefix(line, "ip:") && !hasIP) {
+			continue
+		}
+
+		result = append(result, line)
+	}
+
+	if hasFlags && sim.flags.String() != "" {
+		result = append(result, "flags: "+sim.flags.String())
+	}
+
+	return result
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGolden(t *testing.T) {
+	dirs := []string{"../part1-06/listing", "../part1-07/listing", "listing"}
+
+	for _, dir := range dirs {
+		t.Run(dir, func(t *testing.T) {
+			files, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) == 0 {
+				t.Skip("no golden files")
+			}
+
+			for _, file := range files {
+				name := strings.TrimSuffix(filepath.Base(file), ".txt")
+
+				t.Run(name, func(t *testing.T) {
+					if err := checkGolden(file); err != nil {
+						t.Error(err)
+					}
+				})
+			}
+		})
+	}
+}
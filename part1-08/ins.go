@@ -0,0 +1,97 @@
+package main
+
+// flat form of a decoded instruction for the simulator
+//
+// The decoder produces a Command per instruction, which is what the
+// formatters and the assembler work with. Executing one means a type
+// switch on the interface and clock estimation on every step, so the
+// simulator flattens it once, see decodecache.go, into a plain struct
+// that dispatches on a byte and has the clocks already worked out.
+
+type InsKind byte
+
+const (
+	Ins_Mov InsKind = iota
+	Ins_Arithmetic
+	Ins_JumpOrLoop
+	Ins_Interrupt
+	Ins_Stack
+	Ins_InOut
+	Ins_Control
+)
+
+type Ins struct {
+	kind InsKind
+	size int
+
+	// first byte of jumps, interrupts, stack, in/out and control
+	op byte
+
+	// mov and arithmetic
+	movTyp   MovType
+	arithTyp ArithmeticType
+	arithOp  ArithmeticOp
+	Common
+	d    byte
+	w    byte
+	data uint16
+
+	// jump displacement, interrupt vector or fixed port
+	inc    int8
+	vector byte
+	port   byte
+
+	// estimated clocks, a conditional jump or loop has two
+	clocks      Clocks
+	takenClocks Clocks
+
+	// the decoded command, for output
+	cmd Command
+}
+
+func flatten(cmd Command, size int) Ins {
+	ins := Ins{size: size, cmd: cmd}
+	ins.clocks = estimateClocks(cmd, false)
+	ins.takenClocks = estimateClocks(cmd, true)
+
+	switch c := cmd.(type) {
+	case *Mov:
+		ins.kind = Ins_Mov
+		ins.movTyp, ins.Common, ins.d, ins.w, ins.data = c.typ, c.Common, c.d, c.w, c.data
+	case *Arithmetic:
+		ins.kind = Ins_Arithmetic
+		ins.arithTyp, ins.arithOp = c.typ, c.op
+		ins.Common, ins.d, ins.w, ins.data = c.Common, c.d, c.w, c.data
+	case *JumpOrLoop:
+		ins.kind = Ins_JumpOrLoop
+		ins.op, ins.inc = c.op, c.inc
+	case *Interrupt:
+		ins.kind = Ins_Interrupt
+		ins.op, ins.vector = c.op, c.vector
+	case *Stack:
+		ins.kind = Ins_Stack
+		ins.op = c.op
+	case *InOut:
+		ins.kind = Ins_InOut
+		ins.op, ins.port = c.op, c.port
+	case *Control:
+		ins.kind = Ins_Control
+		ins.op = c.op
+	default:
+		panic("unreachable")
+	}
+
+	return ins
+}
+
+func (ins *Ins) isHalt() bool {
+	return ins.kind == Ins_Control && ins.op == Control_Hlt
+}
+
+func (ins *Ins) isSti() bool {
+	return ins.kind == Ins_Control && ins.op == Control_Sti
+}
+
+func (ins *Ins) isBranch() bool {
+	return ins.kind == Ins_JumpOrLoop
+}
@@ -0,0 +1,179 @@
+package main
+
+import "fmt"
+
+// software and hardware interrupts
+//
+// The program is loaded at 0000:0000, on top of the vector table, so an
+// entry is only used once both its offset and segment are written, by the
+// program, `-load` or the debugger. Until then the interrupt goes to the
+// emulated BIOS service, int 08h for the timer and int 10h for video.
+//
+// The BIOS data area after the table is only kept up to date when the
+// program ends before it, otherwise it's the program's code.
+//
+// ip is a physical address, cs only matters for the return address
+// pushed by an interrupt and for iret.
+
+// 256 vectors of offset and segment
+const vectorTableSize = 256 * 4
+
+// 0040:0000, right after the vector table
+const biosDataArea = 0x400
+
+// mark the vector table bytes of a write to [addr, addr+size)
+func (s *Sim) install(addr int, size int) {
+	for a := addr; a < addr+size && a < vectorTableSize; a++ {
+		s.installed[a/64] |= 1 << (a % 64)
+	}
+}
+
+// all 4 bytes of the entry are written
+func (s *Sim) isInstalled(vector byte) bool {
+	entry := int(vector) * 4
+	return s.installed[entry/64]>>(entry%64)&0xf == 0xf
+}
+
+func (s *Sim) handleInterrupt(ins *Ins) error {
+	i := Interrupt{ins.op, ins.vector}
+
+	if i.isReturn() {
+		offset := s.pop()
+		s.sregs[1] = s.pop()
+		s.flags.setWord(s.pop())
+		s.ip = int(s.sregs[1])<<4 + int(offset)
+		return nil
+	}
+
+	return s.interrupt(i.vector)
+}
+
+// push flags and the return address, jump through the vector table
+func (s *Sim) interrupt(vector byte) error {
+	if !s.isInstalled(vector) {
+		return s.biosService(vector)
+	}
+
+	entry := int(vector) * 4
+	offset := s.readMem(entry, 1)
+	segment := s.readMem(entry+2, 1)
+
+	s.push(s.flags.word())
+	s.flags.interrupt = false
+	s.push(s.sregs[1])
+	s.push(uint16(s.ip - int(s.sregs[1])<<4))
+
+	s.sregs[1] = segment
+	s.ip = int(segment)<<4 + int(offset)
+
+	return nil
+}
+
+func (s *Sim) biosService(vector byte) error {
+	switch vector {
+	case 0x08:
+		return s.timerService()
+	case 0x10:
+		return s.videoService()
+	}
+
+	return fmt.Errorf("unsupported interrupt %02xh, no handler is installed", vector)
+}
+
+// int 08h, count the tick at 0040:006C and acknowledge the PIC
+func (s *Sim) timerService() error {
+	if s.initSize > biosDataArea {
+		s.pic.endOfInterrupt()
+		return nil
+	}
+
+	ticks := uint32(s.readMem(0x46c, 1)) | uint32(s.readMem(0x46e, 1))<<16
+	ticks += 1
+
+	s.writeMem(0x46c, uint16(ticks), 1)
+	s.writeMem(0x46e, uint16(ticks>>16), 1)
+
+	s.pic.endOfInterrupt()
+	return nil
+}
+
+func (s *Sim) handleControl(ins *Ins) error {
+	switch ins.op {
+	case Control_Cli:
+		s.flags.interrupt = false
+	case Control_Sti:
+		s.flags.interrupt = true
+	case Control_Hlt:
+		{
+			if !s.flags.interrupt {
+				return fmt.Errorf("hlt with interrupts disabled never resumes")
+			}
+
+			if s.clocksToInterrupt(s.totalClocks) < 0 {
+				return fmt.Errorf("hlt never resumes, no interrupt is coming")
+			}
+		}
+	}
+
+	return nil
+}
+
+// clocks from t until an interrupt can be taken, assuming interrupts
+// are enabled, -1 if none is coming
+func (s *Sim) clocksToInterrupt(t int) int {
+	if s.pic.pending() >= 0 {
+		return 0
+	}
+
+	// would the timer get through
+	pic := s.pic
+	pic.raise(0)
+	if pic.pending() != 0 {
+		return -1
+	}
+
+	ticks := s.pit.channels[0].nextEdge(s.pit.now)
+	if ticks < 0 {
+		return -1
+	}
+
+	return max(0, (s.pit.now+ticks)*pitTickClocks-t)
+}
+
+// bring the timer up to date and take a pending interrupt, returns its
+// vector, -1 for none, and the clocks it took
+func (s *Sim) serviceIRQ(ins *Ins) (int, int, error) {
+	if s.pit.advance(s.totalClocks / pitTickClocks) {
+		s.pic.raise(0)
+	}
+
+	// recognized after the instruction following sti
+	if ins.isSti() {
+		return -1, 0, nil
+	}
+
+	irq := s.pic.pending()
+	if !s.flags.interrupt || irq < 0 {
+		return -1, 0, nil
+	}
+
+	reads, writes := len(s.memReads), len(s.memWrites)
+	penalty := s.busPenalty()
+
+	vector := s.pic.acknowledge(irq)
+	if err := s.interrupt(vector); err != nil {
+		return -1, 0, err
+	}
+
+	clocks := Clocks{base: 61, penalty: s.busPenalty() - penalty}
+
+	if s.prefetch != nil {
+		busCycles := len(s.memReads) - reads + len(s.memWrites) - writes + clocks.penalty/4
+		clocks.stall = s.prefetch.interrupt(clocks, busCycles, s.ip)
+		s.totalStalls += clocks.stall
+	}
+
+	s.totalClocks += clocks.total()
+
+	return int(vector), clocks.total(), nil
+}
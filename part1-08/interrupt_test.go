@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// a vector is used once both its offset and segment are written
+func TestInstallVector(t *testing.T) {
+	prog := assembleSource(t, "bits 16\nmov word [0x20], 0x100\nmov byte [0x22], 0\n")
+	s := newSim(prog.code)
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := s.step(); err != nil {
+			t.Fatal(err)
+		}
+		if s.isInstalled(0x08) {
+			t.Fatalf("int 08h installed after %d writes", i+1)
+		}
+	}
+
+	s.pokeMem(0x23, 0, 0)
+	if !s.isInstalled(0x08) {
+		t.Error("int 08h not installed after writing all of it")
+	}
+	if s.isInstalled(0x09) {
+		t.Error("int 09h installed")
+	}
+}
+
+// the BIOS tick count would be written into the code
+func TestTimerServiceOverCode(t *testing.T) {
+	prog := assembleSource(t, timerLoop+"times 600 mov ax, ax\n")
+	if len(prog.code) <= 0x470 {
+		t.Fatalf("program of %d bytes doesn't cover the tick count", len(prog.code))
+	}
+
+	s := newSim(prog.code)
+	irqs := 0
+	for _, d := range runSim(t, s) {
+		if d.irq {
+			irqs += 1
+		}
+	}
+
+	if irqs == 0 {
+		t.Fatal("no timer interrupts")
+	}
+	// the loop itself writes [1000]
+	if !bytes.Equal(s.mem[0x46c:0x470], prog.code[0x46c:0x470]) {
+		t.Error("the timer service wrote into the code")
+	}
+}
+
+func TestTimerServiceTicks(t *testing.T) {
+	s := newSim(assembleSource(t, timerLoop).code)
+
+	irqs := 0
+	for _, d := range runSim(t, s) {
+		if d.irq {
+			irqs += 1
+		}
+	}
+
+	ticks := int(s.readMem(0x46c, 1)) | int(s.readMem(0x46e, 1))<<16
+	if irqs == 0 || ticks != irqs {
+		t.Errorf("%d ticks counted for %d interrupts", ticks, irqs)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// one line of `-format json` output
+type jsonInstruction struct {
+	Offset   int           `json:"offset"`
+	Bytes    []int         `json:"bytes"`
+	Mnemonic string        `json:"mnemonic"`
+	Operands []jsonOperand `json:"operands"`
+	Text     string        `json:"text"`
+	Exec     *jsonExec     `json:"exec,omitempty"`
+}
+
+type jsonOperand struct {
+	// register, memory, immediate or relative
+	Kind  string `json:"kind"`
+	Width int    `json:"width,omitempty"`
+
+	Register string `json:"register,omitempty"`
+	// memory, e.g. `bp + si`, empty for direct address
+	Base         string `json:"base,omitempty"`
+	Displacement int    `json:"displacement,omitempty"`
+	Address      *int   `json:"address,omitempty"`
+	// immediate
+	Value *int `json:"value,omitempty"`
+	// relative to the start of the instruction
+	Offset *int `json:"offset,omitempty"`
+}
+
+type jsonExec struct {
+	Regs  []jsonChange    `json:"regs"`
+	IP    jsonChange      `json:"ip"`
+	Flags *jsonFlagChange `json:"flags,omitempty"`
+	Mem   []jsonChange    `json:"mem,omitempty"`
+	// estimated clocks of this instruction
+	Clocks int `json:"clocks"`
+	// vector of a hardware interrupt taken after the instruction
+	IRQ *int `json:"irq,omitempty"`
+}
+
+type jsonChange struct {
+	Name    string `json:"name,omitempty"`
+	Address *int   `json:"address,omitempty"`
+	Width   int    `json:"width,omitempty"`
+	Old     int    `json:"old"`
+	New     int    `json:"new"`
+}
+
+type jsonFlagChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+func widthBits(wide byte) int {
+	if wide == 1 {
+		return 16
+	}
+	return 8
+}
+
+func toJSONOperand(o Operand) jsonOperand {
+	result := jsonOperand{}
+
+	switch o.typ {
+	case Operand_Register:
+		{
+			result.Kind = "register"
+			result.Width = widthBits(o.wide)
+			result.Register = regName(o.reg, o.wide)
+		}
+	case Operand_SegmentRegister:
+		{
+			result.Kind = "register"
+			result.Width = 16
+			result.Register = SEGMENT_REGISTERS[o.reg]
+		}
+	case Operand_Memory:
+		{
+			result.Kind = "memory"
+			result.Width = widthBits(o.wide)
+
+			if o.isDirect() {
+				addr := int(uint16(o.mem.disp))
+				result.Address = &addr
+			} else {
+				result.Base = o.memBase()
+				result.Displacement = int(o.mem.disp)
+			}
+		}
+	case Operand_Immediate:
+		{
+			result.Kind = "immediate"
+			result.Width = widthBits(o.wide)
+			value := int(o.imm)
+			result.Value = &value
+		}
+	case Operand_Relative:
+		{
+			result.Kind = "relative"
+			offset := o.rel
+			result.Offset = &offset
+		}
+	}
+
+	return result
+}
+
+func toJSONExec(d *Delta) *jsonExec {
+	result := &jsonExec{
+		Regs:   []jsonChange{},
+		IP:     jsonChange{Old: d.oldIP, New: d.newIP},
+		Clocks: d.clocks.total(),
+	}
+
+	for _, r := range d.regs {
+		result.Regs = append(result.Regs, jsonChange{Name: r.name(), Old: int(r.old), New: int(r.new)})
+	}
+
+	if d.irq {
+		vector := int(d.vector)
+		result.IRQ = &vector
+	}
+
+	if d.oldFlags != d.newFlags {
+		result.Flags = &jsonFlagChange{d.oldFlags.String(), d.newFlags.String()}
+	}
+
+	for _, m := range d.mem {
+		addr := m.addr
+		result.Mem = append(result.Mem, jsonChange{Address: &addr, Width: widthBits(m.wide), Old: int(m.old), New: int(m.new)})
+	}
+
+	return result
+}
+
+// delta is nil when not executing
+func formatJSONLine(offset int, raw []byte, cmd Command, formatter Formatter, delta *Delta) (string, error) {
+	ins := cmd.Instruction()
+
+	result := jsonInstruction{
+		Offset:   offset,
+		Bytes:    make([]int, len(raw)),
+		Mnemonic: ins.op,
+		Operands: make([]jsonOperand, len(ins.operands)),
+		Text:     formatter.Format(ins),
+	}
+
+	for idx, b := range raw {
+		result.Bytes[idx] = int(b)
+	}
+
+	for idx, o := range ins.operands {
+		result.Operands[idx] = toJSONOperand(o)
+	}
+
+	if delta != nil {
+		result.Exec = toJSONExec(delta)
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
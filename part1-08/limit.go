@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+)
+
+// execution budget and infinite loop detection for exec mode
+//
+// The machine is deterministic, so if it's in the same state twice it
+// loops forever. States are compared at backward branches with Brent's
+// cycle detection, which keeps one state instead of all of them. A state
+// is a hash of the registers, flags, memory, video and interrupt state,
+// memory is hashed incrementally as it's written. Equal hashes are only a
+// hint, the saved state is compared before reporting a loop.
+//
+// Detection is off while the timer is counting: interrupts make the
+// future depend on the time, which never repeats.
+
+type Limiter struct {
+	// 0 for no limit
+	maxInstructions int
+	maxClocks       int
+
+	count int
+
+	// the last backward branch, from the branch to its target
+	loopFrom, loopTo int
+	looped           bool
+
+	// state saved at a power of two number of backward branches
+	saved      uint64
+	savedState loopState
+	savedMem   []byte
+	savedCount int
+	power      int
+	length     int
+}
+
+func newLimiter(maxInstructions int, maxClocks int) *Limiter {
+	return &Limiter{maxInstructions: maxInstructions, maxClocks: maxClocks, power: 1}
+}
+
+// account for an executed instruction, an error stops the program
+func (l *Limiter) check(s *Sim, d *Delta) error {
+	l.count += 1
+
+	backward := d.newIP <= d.oldIP && !d.irq
+	if backward {
+		l.loopFrom, l.loopTo, l.looped = d.oldIP, d.newIP, true
+	}
+
+	if backward && !s.pit.channels[0].armed {
+		state := s.stateHash()
+
+		if l.savedCount > 0 && state == l.saved && l.repeats(s) {
+			return fmt.Errorf("stuck at ip 0x%04x: the machine state repeats every %d instructions, the loop 0x%04x-0x%04x never exits\n%s",
+				s.ip, l.count-l.savedCount, l.loopTo, l.loopFrom, l.summary(s))
+		}
+
+		l.length += 1
+		if l.length == l.power {
+			l.saved, l.savedCount = state, l.count
+			l.savedState = s.loopState()
+			l.savedMem = append(l.savedMem[:0], s.mem...)
+			l.power *= 2
+			l.length = 0
+		}
+	}
+
+	if l.maxInstructions > 0 && l.count >= l.maxInstructions {
+		return fmt.Errorf("instruction limit %d reached at ip 0x%04x%s\n%s", l.maxInstructions, s.ip, l.lastLoop(), l.summary(s))
+	}
+
+	if l.maxClocks > 0 && s.totalClocks >= l.maxClocks {
+		return fmt.Errorf("clock limit %d reached at ip 0x%04x%s\n%s", l.maxClocks, s.ip, l.lastLoop(), l.summary(s))
+	}
+
+	return nil
+}
+
+// the machine is in the saved state, not just a state with the same hash
+func (l *Limiter) repeats(s *Sim) bool {
+	return s.loopState() == l.savedState && bytes.Equal(s.mem, l.savedMem)
+}
+
+func (l *Limiter) lastLoop() string {
+	if !l.looped {
+		return ""
+	}
+	return fmt.Sprintf(", the last backward branch is 0x%04x -> 0x%04x", l.loopFrom, l.loopTo)
+}
+
+func (l *Limiter) summary(s *Sim) string {
+	return fmt.Sprintf("after %d instructions, %d clocks", l.count, s.totalClocks)
+}
+
+// splitmix64 finalizer
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// contribution of a memory byte, zero bytes contribute nothing
+func memByteHash(addr int, b byte) uint64 {
+	if b == 0 {
+		return 0
+	}
+	return mix64(uint64(addr)<<8 | uint64(b))
+}
+
+// xor of all byte hashes, kept up to date by pokeMem once computed
+func (s *Sim) memoryHash() uint64 {
+	if !s.memHashValid {
+		s.memHash = 0
+		for addr, b := range s.mem {
+			s.memHash ^= memByteHash(addr, b)
+		}
+		s.memHashValid = true
+	}
+
+	return s.memHash
+}
+
+// the state hashed by stateHash besides memory
+type loopState struct {
+	regs      [8]uint16
+	sregs     [4]uint16
+	flags     uint16
+	ip        int
+	mode      byte
+	row, col  int
+	pic       [4]byte
+	installed [vectorTableSize / 64]uint64
+}
+
+func (s *Sim) loopState() loopState {
+	return loopState{
+		regs:      s.regs,
+		sregs:     s.sregs,
+		flags:     s.flags.word(),
+		ip:        s.ip,
+		mode:      s.video.mode,
+		row:       s.video.row,
+		col:       s.video.col,
+		pic:       [4]byte{s.pic.base, s.pic.imr, s.pic.irr, s.pic.isr},
+		installed: s.installed,
+	}
+}
+
+// everything that decides what the machine does next
+func (s *Sim) stateHash() uint64 {
+	h := s.memoryHash()
+
+	add := func(v uint64) {
+		h = mix64(bits.RotateLeft64(h, 5) ^ v)
+	}
+
+	for _, r := range s.regs {
+		add(uint64(r))
+	}
+	for _, r := range s.sregs {
+		add(uint64(r))
+	}
+
+	add(uint64(s.flags.word()))
+	add(uint64(s.ip))
+	add(uint64(s.video.mode)<<16 | uint64(s.video.row)<<8 | uint64(s.video.col))
+	add(uint64(s.pic.base)<<24 | uint64(s.pic.imr)<<16 | uint64(s.pic.irr)<<8 | uint64(s.pic.isr))
+
+	for _, v := range s.installed {
+		add(v)
+	}
+
+	return h
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLimiterStuck(t *testing.T) {
+	prog := assembleSource(t, "bits 16\nmov cx, 3\ntop:\nsub cx, 0\njnz top\n")
+	run := runStepEngine(newSim(prog.code), newLimiter(0, 0))
+
+	if !strings.Contains(run.err, "stuck at ip 0x0003") {
+		t.Errorf("loop not detected: %s", run)
+	}
+}
+
+// a state with the saved hash but different registers or memory isn't a loop
+func TestLimiterHashCollision(t *testing.T) {
+	prog := assembleSource(t, "bits 16\ntop:\nsub cx, 0\njz top\n")
+	backward := &Delta{oldIP: 0, newIP: 0}
+
+	tests := []struct {
+		name   string
+		change func(s *Sim)
+	}{
+		{"register", func(s *Sim) { s.regs[0] = 1 }},
+		{"flags", func(s *Sim) { s.flags.zero = true }},
+		{"memory", func(s *Sim) { s.pokeByte(1000, 1) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSim(prog.code)
+			l := newLimiter(0, 0)
+			if err := l.check(s, backward); err != nil {
+				t.Fatal(err)
+			}
+
+			// pretend the changed state hashes like the saved one
+			tt.change(s)
+			l.saved = s.stateHash()
+			if err := l.check(s, backward); err != nil {
+				t.Errorf("collision reported as a loop: %v", err)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -14,101 +15,486 @@ import (
 var debugFlag *bool
 var execFlag *bool
 
-// check disassemble result by comparing reassemble binary with original binary
+// show estimated clocks in exec mode
+var clocksFlag *bool
+
+// 8086 or 8088, they differ in bus width
+var cpuFlag *string
+
+// model the prefetch queue and bus cycles on top of the clock estimation
+var prefetchFlag *bool
+
+// output format: `asm` (default), `listing` or `json`
+var formatFlag *string
+
+// assembler syntax of the output: nasm (default), masm or att
+var syntaxFlag *string
+
+// check disassemble result by comparing reassemble binary with original binary,
+// the original has to be a binary, an .asm source would be assembled by
+// the builtin assembler and compared with itself
 var checkFlag *bool
 
+// use external `nasm` instead of the builtin assembler in check mode
+var nasmFlag *bool
+
+// compare execution with golden `.txt` files in listing directories
+var goldenFlag *bool
+
+// interactive step debugger
+var replFlag *bool
+
+// serve the gdb remote protocol on this address
+var gdbFlag *string
+
+// serve the debug adapter protocol on this address
+var dapFlag *string
+
+// write the machine state after exec to a snapshot file
+var saveFlag *string
+
+// start from a snapshot file instead of a program
+var restoreFlag *string
+
+// write memory to a file at the end, `file` or `file@addr:len`
+var dumpFlag *string
+
+// files copied into memory before running, `addr:file`
+var loadFlag memLoads
+
+// render a memory region as png, see png.go
+var pngFlag *string
+var pngAddrFlag *string
+var pngSizeFlag *string
+var pngFormatFlag *string
+var pngEveryFlag *int
+
+// print the text mode screen at the end, or redraw it while running,
+// see video.go
+var screenFlag *string
+var screenLiveFlag *bool
+
+// print a profile of the executed instructions at the end, see profile.go
+var profileFlag *bool
+
+// print a coverage report at the end and write an lcov tracefile, see coverage.go
+var coverageFlag *bool
+var lcovFlag *string
+
+// stop exec mode after this many instructions or clocks, 0 for no limit
+var maxInstructionsFlag *int
+var maxClocksFlag *int
+
+// number of random instructions to cross check decoder and assembler
+var fuzzFlag *int
+var seedFlag *int64
+
+// number of instructions of the simulation benchmark, see bench.go
+var benchFlag *int
+
+// exec mode engine: `step` (default) or `blocks`, see blocks.go
+var engineFlag *string
+
+// run programs on both engines and compare, see crosscheck.go
+var crosscheckFlag *bool
+
 func main() {
-	checkFlag = flag.Bool("check", false, "enable check mode")
+	checkFlag = flag.Bool("check", false, "reassemble the disassembly and compare it with the binary")
+	nasmFlag = flag.Bool("nasm", false, "use external nasm in check mode")
+	goldenFlag = flag.Bool("golden", false, "run golden files in the given listing directories")
+	dapFlag = flag.String("dap", "", "serve the debug adapter protocol on `addr`, the client launches the program")
+	fuzzFlag = flag.Int("fuzz", 0, "cross check decoder and assembler with n random instructions")
+	seedFlag = flag.Int64("seed", 1, "random seed of fuzz mode")
+	engineFlag = flag.String("engine", "step", "exec engine: step, blocks; blocks only prints the final state")
+	crosscheckFlag = flag.Bool("crosscheck", false, "run the given programs on both engines and compare the results")
+	benchFlag = flag.Int("bench", 0, "time a loop of about `n` instructions on the engines")
 	debugFlag = flag.Bool("debug", false, "enable debug mode")
 	execFlag = flag.Bool("exec", false, "exec")
+	replFlag = flag.Bool("repl", false, "run the program in the interactive debugger")
+	gdbFlag = flag.String("gdb", "", "serve the gdb remote protocol on `addr`, e.g. localhost:1234")
+	saveFlag = flag.String("save", "", "save the machine state after exec to `file`")
+	restoreFlag = flag.String("restore", "", "start from the machine state in `file` instead of a program")
+	dumpFlag = flag.String("dump", "", "write memory to `file` at the end, or a range with file@addr:len")
+	flag.Var(&loadFlag, "load", "copy a file into memory before running, `addr:file`, repeatable")
+	pngFlag = flag.String("png", "", "write a memory region as png to `file` at the end")
+	pngAddrFlag = flag.String("png-addr", "0", "physical address of the png region")
+	pngSizeFlag = flag.String("png-size", "64x64", "png size in pixels, WxH")
+	pngFormatFlag = flag.String("png-format", "rgba", "png pixel format: rgba, indexed")
+	pngEveryFlag = flag.Int("png-every", 0, "also write a png every `n` instructions in exec mode")
+	screenFlag = flag.String("screen", "", "print the text screen after exec: cga, mda")
+	screenLiveFlag = flag.Bool("screen-live", false, "redraw the -screen in the terminal while exec runs, instead of the trace")
+	profileFlag = flag.Bool("profile", false, "print hot spots and an annotated listing after exec")
+	coverageFlag = flag.Bool("coverage", false, "print executed instructions and branch directions after exec")
+	lcovFlag = flag.String("lcov", "", "write an lcov tracefile of an .asm program to `file` after exec")
+	maxInstructionsFlag = flag.Int("max-instructions", 0, "stop exec mode after `n` instructions, 0 for no limit")
+	maxClocksFlag = flag.Int("max-clocks", 0, "stop exec mode after `n` estimated clocks, 0 for no limit")
+	clocksFlag = flag.Bool("clocks", false, "show estimated clocks in exec mode")
+	cpuFlag = flag.String("cpu", "8086", "cpu for clock estimation: 8086, 8088")
+	prefetchFlag = flag.Bool("prefetch", false, "model the prefetch queue in clock estimation")
+	formatFlag = flag.String("format", "asm", "output format: asm, listing, json")
+	syntaxFlag = flag.String("syntax", "nasm", "output syntax: nasm, masm, att")
 	flag.Parse()
 
-	if len(flag.Args()) == 0 {
-		fmt.Println("usage: ./sim0086 [-check] [-debug] [-exec] <binary>")
+	if *fuzzFlag > 0 {
+		if !runFuzz(*fuzzFlag, *seedFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *benchFlag > 0 {
+		if !runBench(*benchFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *cpuFlag != "8086" && *cpuFlag != "8088" {
+		log.Fatalf("unknown cpu: %s", *cpuFlag)
+	}
+
+	if *engineFlag != "step" && *engineFlag != "blocks" {
+		log.Fatalf("unknown engine: %s", *engineFlag)
+	}
+
+	// per instruction output needs the step engine
+	blocksEngine := *engineFlag == "blocks"
+	if blocksEngine && (!*execFlag || *checkFlag || *formatFlag != "asm") {
+		log.Fatalf("the blocks engine needs -exec, without -check and -format")
+	}
+
+	// reports of the executed program, nothing runs without -exec
+	if !*execFlag && (*clocksFlag || *profileFlag || *coverageFlag || *lcovFlag != "") {
+		log.Fatalf("-clocks, -profile, -coverage and -lcov need -exec")
+	}
+
+	if *dapFlag != "" {
+		if err := serveDAP(*dapFlag); err != nil {
+			log.Fatalf("dap server error: %v", err)
+		}
+		return
+	}
+
+	if len(flag.Args()) == 0 && *restoreFlag == "" {
+		fmt.Println("usage: ./sim0086 [-check [-nasm]] [-debug] [-exec [-clocks [-cpu 8086|8088] [-prefetch]] [-engine step|blocks] [-profile] [-coverage] [-lcov <file>] [-max-instructions <n>] [-max-clocks <n>] [-save <file>]] [-load <addr:file>]... [-dump <file[@addr:len]>] [-png <file> [-png-addr <addr>] [-png-size WxH] [-png-format rgba|indexed] [-png-every <n>]] [-screen cga|mda [-screen-live]] [-format asm|listing|json] [-syntax nasm|masm|att] <binary|file.asm|-restore <file>>")
+		fmt.Println("       ./sim0086 -repl [-cpu 8086|8088] [-prefetch] <binary|file.asm|-restore <file>>")
+		fmt.Println("       ./sim0086 -gdb <addr> [-cpu 8086|8088] [-prefetch] <binary|file.asm|-restore <file>>")
+		fmt.Println("       ./sim0086 -dap <addr> [-cpu 8086|8088] [-prefetch]")
+		fmt.Println("       ./sim0086 -golden <listing dir>...")
+		fmt.Println("       ./sim0086 -fuzz <n> [-seed <seed>]")
+		fmt.Println("       ./sim0086 -crosscheck [-cpu 8086|8088] [-prefetch] [-max-instructions <n>] [-max-clocks <n>] <binary|file.asm>...")
+		fmt.Println("       ./sim0086 -bench <n>")
 		os.Exit(0)
 	}
 
-	file := flag.Arg(0)
-	base := filepath.Base(file)
+	if *crosscheckFlag {
+		if !runCrosscheck(flag.Args()) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *goldenFlag {
+		if !runGolden(flag.Args()) {
+			os.Exit(1)
+		}
+		return
+	}
 
-	buf, err := ioutil.ReadFile(file)
+	formatter, err := getFormatter(*syntaxFlag)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	fmt.Printf("; disassembled by sim006: %s\n", file)
+	if *formatFlag != "asm" && *formatFlag != "listing" && *formatFlag != "json" {
+		log.Fatalf("unknown format: %s", *formatFlag)
+	}
+
+	file := flag.Arg(0)
+
+	var buf []byte
+	var prog *Program
+	var sim *Sim
+
+	// the snapshot has the cpu model
+	if *restoreFlag != "" {
+		if *checkFlag {
+			log.Fatalf("check mode needs a program, not a snapshot")
+		}
+
+		file = *restoreFlag
+		sim = newSim(nil)
+		if err := loadSnapshot(file, sim); err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		if *checkFlag && strings.HasSuffix(file, ".asm") {
+			log.Fatalf("check mode needs a binary, an .asm source would only check the builtin assembler against itself")
+		}
+
+		buf, prog, err = loadProgram(file)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sim = setupSim(buf)
+	}
+
+	base := filepath.Base(file)
+
+	if err := sim.loadFiles(loadFlag); err != nil {
+		log.Fatalf("could not load: %v", err)
+	}
+
+	if *dumpFlag != "" {
+		if _, _, _, err := parseDumpSpec(*dumpFlag); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	var pngConf *pngConfig
+	if *pngFlag != "" {
+		pngConf, err = newPNGConfig(*pngFlag, *pngAddrFlag, *pngSizeFlag, *pngFormatFlag, *pngEveryFlag)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	var screenMode byte
+	switch *screenFlag {
+	case "":
+	case "cga":
+		screenMode = 3
+	case "mda":
+		screenMode = 7
+	default:
+		log.Fatalf("unknown screen: %s", *screenFlag)
+	}
+
+	var live *LiveScreen
+	if *screenLiveFlag {
+		if screenMode == 0 || !*execFlag || *checkFlag || *formatFlag != "asm" {
+			log.Fatalf("-screen-live needs -screen and -exec, without -check and -format")
+		}
+		live = newLiveScreen(os.Stdout)
+	}
+
+	// a snapshot already has the screen contents
+	if screenMode != 0 && *restoreFlag != "" {
+		sim.video.mode = screenMode
+	} else if screenMode != 0 {
+		sim.initVideo(screenMode)
+	}
+
+	// executed instructions
+	count := 0
+
+	if *profileFlag {
+		sim.profile = newProfile()
+	}
+
+	if *lcovFlag != "" && prog == nil {
+		log.Fatalf("lcov needs an .asm program")
+	}
+
+	if *coverageFlag || *lcovFlag != "" {
+		sim.coverage = newCoverage()
+	}
+
+	limiter := newLimiter(*maxInstructionsFlag, *maxClocksFlag)
+	// why exec mode stopped early, reported after the final state
+	var stopErr error
+
+	if *replFlag {
+		newDebugger(sim, prog, os.Stdout).run(os.Stdin)
+		return
+	}
+
+	if *gdbFlag != "" {
+		if err := serveGDB(*gdbFlag, sim); err != nil {
+			log.Fatalf("gdb server error: %v", err)
+		}
+		return
+	}
+
+	// json output is one object per line, without header and final state
+	jsonFormat := *formatFlag == "json"
+
+	if !jsonFormat {
+		fmt.Printf("%s disassembled by sim006: %s\n", formatter.Comment(), file)
+	}
 
 	var output []string = []string{"bits 16"}
 
-	sim := newSim(buf)
+	if !jsonFormat {
+		fmt.Println(formatter.Header())
+	}
+
+	if blocksEngine {
+		sim.trace = false
+		sim.blocks = newBlockEngine()
 
-	fmt.Println("bits 16")
-	for {
-		cmd, err := sim.disassemble()
+		err := sim.blocks.run(sim, func(d *Delta) error {
+			count += 1
+
+			if pngConf != nil && pngConf.every > 0 && count%pngConf.every == 0 {
+				if err := sim.writePNG(pngConf, pngConf.frameFile(count)); err != nil {
+					log.Fatalf("could not write png: %v", err)
+				}
+			}
+
+			if live != nil {
+				live.update(sim)
+			}
+
+			stopErr = limiter.check(sim, d)
+			return stopErr
+		})
+		if err != nil && err != stopErr {
+			log.Fatalf("failed to do simulation: %v", err)
+		}
+	}
+
+	for !blocksEngine && stopErr == nil {
+		ins, err := sim.decode()
 
 		if err != nil {
 			log.Fatalln(err)
 		}
 
 		// reach the end
-		if cmd == nil {
+		if ins == nil {
 			break
 		}
 
-		var debugInfo string
+		cmd := ins.cmd
+
+		var delta *Delta
+
+		// capture before exec, ip may be changed by jumps and the
+		// instruction may overwrite itself
+		offset := sim.ip
+		raw := append([]byte(nil), sim.mem[offset:offset+sim.lastInsSize]...)
 
 		if *execFlag {
-			var err error
-			debugInfo, err = sim.exec(cmd)
+			d, err := sim.execIns(ins)
 			if err != nil {
 				log.Fatalf("failed to do simulation: %v", err)
 			}
+			delta = &d
+			count += 1
+			stopErr = limiter.check(sim, delta)
+
+			if pngConf != nil && pngConf.every > 0 && count%pngConf.every == 0 {
+				if err := sim.writePNG(pngConf, pngConf.frameFile(count)); err != nil {
+					log.Fatalf("could not write png: %v", err)
+				}
+			}
+
+			// the screen instead of the trace
+			if live != nil {
+				live.update(sim)
+				continue
+			}
 		} else {
 			// increase ip
 			sim.ip += sim.lastInsSize
 		}
 
-		str := cmd.Disassemble()
-		fmt.Print(str)
+		// check mode always reassembles with nasm
+		output = append(output, cmd.Disassemble())
 
-		if debugInfo != "" {
-			fmt.Printf(" ; %s\n", debugInfo)
+		if jsonFormat {
+			line, err := formatJSONLine(offset, raw, cmd, formatter, delta)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			fmt.Println(line)
+			continue
+		}
+
+		str := formatter.Format(cmd.Instruction())
+
+		if *formatFlag == "listing" {
+			fmt.Print(formatListingLine(offset, raw, str))
+		} else {
+			fmt.Print(str)
+		}
+
+		if delta != nil && *clocksFlag {
+			fmt.Printf(" %s Clocks: +%d = %d%s | %s\n", formatter.Comment(), delta.clocks.total(), sim.totalClocks, delta.clocks.detail(), delta.String())
+		} else if delta != nil {
+			fmt.Printf(" %s %s\n", formatter.Comment(), delta.String())
 		} else {
 			fmt.Print("\n")
 		}
+	}
 
-		output = append(output, str)
+	if live != nil {
+		live.draw(sim)
 	}
 
-	if *execFlag {
+	if *execFlag && !jsonFormat {
 		fmt.Println()
 		fmt.Print(sim.dumpRegs())
 		fmt.Print(sim.dumpFlags())
+
+		if *clocksFlag {
+			fmt.Print(sim.dumpClocks())
+		}
 	}
 
-	// use `nasm` to assemble our disassemble file
-	// and then compare it to origin binary
-	// source: a
-	// our disassemble: a.sim0086.asm
-	// nasm reassemble: a.sim0086
-	// then compare a and a.sim0086
-	if *checkFlag {
-		result := strings.Join(output, "\n")
-		tmpPath := fmt.Sprintf("%s.sim0086.asm", base)
+	if *execFlag && *profileFlag {
+		fmt.Println()
+		sim.profile.report(os.Stdout, sim, prog, formatter)
+	}
+
+	if *execFlag && *coverageFlag {
+		fmt.Println()
+		sim.coverage.report(os.Stdout, sim, prog, formatter)
+	}
 
-		if err := ioutil.WriteFile(tmpPath, []byte(result), 0644); err != nil {
-			log.Fatalf("could not write result into %s: %v\n", tmpPath, err)
+	if *execFlag && *lcovFlag != "" {
+		if err := sim.coverage.writeLCOV(*lcovFlag, sim, prog, file); err != nil {
+			log.Fatalf("could not write lcov: %v", err)
 		}
+	}
 
-		if err := nasmAssembleFile(tmpPath); err != nil {
-			log.Fatalf("nasm error: %v", err)
+	if *execFlag && *screenFlag != "" && live == nil {
+		fmt.Println()
+		sim.renderScreen(os.Stdout)
+	}
+
+	if *execFlag && *saveFlag != "" {
+		if err := saveSnapshot(*saveFlag, sim); err != nil {
+			log.Fatalf("could not save snapshot: %v", err)
 		}
+	}
 
-		nasmPath := fmt.Sprintf("%s.sim0086", base)
+	if pngConf != nil {
+		if err := sim.writePNG(pngConf, pngConf.file); err != nil {
+			log.Fatalf("could not write png: %v", err)
+		}
+	}
 
-		same, err := compareTwoFiles(file, nasmPath)
-		if err != nil {
-			log.Fatalf("could not compare %s and %s: %v", file, nasmPath, err)
+	if *dumpFlag != "" {
+		if err := sim.dumpMemory(*dumpFlag); err != nil {
+			log.Fatalf("could not dump memory: %v", err)
+		}
+	}
+
+	// assemble our disassemble result and compare it to origin binary
+	if *checkFlag {
+		result := strings.Join(output, "\n")
+
+		var same bool
+		if *nasmFlag {
+			same = nasmCheck(file, base, result)
+		} else {
+			prog, err := assemble(result)
+			if err != nil {
+				log.Fatalf("assemble error: %v", err)
+			}
+			same = bytes.Equal(prog.code, buf)
 		}
 
 		if !same {
@@ -117,6 +503,80 @@ func main() {
 			fmt.Println("=== Ok")
 		}
 	}
+
+	if stopErr != nil {
+		log.Fatalln(stopErr)
+	}
+}
+
+// simulator with the cpu model from the flags
+func setupSim(buf []byte) *Sim {
+	sim := newSim(buf)
+	sim.is8088 = *cpuFlag == "8088"
+
+	if *prefetchFlag {
+		sim.prefetch = newPrefetcher(sim.is8088)
+	}
+
+	return sim
+}
+
+// binary file, or source file ends with `.asm` which is assembled first
+func loadProgram(fp string) ([]byte, *Program, error) {
+	if strings.HasSuffix(fp, ".asm") {
+		prog, err := assembleFile(fp)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not assemble %s: %w", fp, err)
+		}
+		return prog.code, prog, nil
+	}
+
+	buf, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return buf, nil, nil
+}
+
+// use `nasm` to assemble our disassemble file
+// and then compare it to origin binary
+// source: a
+// our disassemble: a.sim0086.asm
+// nasm reassemble: a.sim0086
+// then compare a and a.sim0086
+func nasmCheck(file, base, result string) bool {
+	tmpPath := fmt.Sprintf("%s.sim0086.asm", base)
+
+	if err := ioutil.WriteFile(tmpPath, []byte(result), 0644); err != nil {
+		log.Fatalf("could not write result into %s: %v\n", tmpPath, err)
+	}
+
+	if err := nasmAssembleFile(tmpPath); err != nil {
+		log.Fatalf("nasm error: %v", err)
+	}
+
+	nasmPath := fmt.Sprintf("%s.sim0086", base)
+
+	same, err := compareTwoFiles(file, nasmPath)
+	if err != nil {
+		log.Fatalf("could not compare %s and %s: %v", file, nasmPath, err)
+	}
+
+	return same
+}
+
+// 8086 instructions are at most 6 bytes long
+const maxInsSize = 6
+
+// e.g. `0003  89 D9              mov cx, bx`
+func formatListingLine(offset int, raw []byte, str string) string {
+	hex := make([]string, len(raw))
+	for idx, b := range raw {
+		hex[idx] = fmt.Sprintf("%02x", b)
+	}
+
+	return fmt.Sprintf("%04x  %-*s  %s", offset, maxInsSize*3-1, strings.Join(hex, " "), str)
 }
 
 // generate binary in the same directory
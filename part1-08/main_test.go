@@ -0,0 +1,12 @@
+package main
+
+import "testing"
+
+// offsets and bytes in the same hex case
+func TestFormatListingLine(t *testing.T) {
+	got := formatListingLine(0x1a, []byte{0xc7, 0x06, 0xe8, 0x03, 0xab, 0x00}, "mov [1000], word 171")
+	want := "001a  c7 06 e8 03 ab 00  mov [1000], word 171"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// `-load addr:file` and `-dump file[@addr:len]`, addresses are physical
+
+type memLoad struct {
+	addr int
+	file string
+}
+
+// repeatable `-load` flag
+type memLoads []memLoad
+
+func (l *memLoads) String() string {
+	var parts []string
+	for _, m := range *l {
+		parts = append(parts, fmt.Sprintf("0x%x:%s", m.addr, m.file))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *memLoads) Set(value string) error {
+	addrStr, file, found := strings.Cut(value, ":")
+	if !found || file == "" {
+		return fmt.Errorf("expected addr:file, got %s", value)
+	}
+
+	addr, err := parseNumber(addrStr)
+	if err != nil || addr < 0 || addr >= memSize {
+		return fmt.Errorf("invalid address %s", addrStr)
+	}
+
+	*l = append(*l, memLoad{addr, file})
+	return nil
+}
+
+// copy the files into memory
+func (s *Sim) loadFiles(loads memLoads) error {
+	for _, m := range loads {
+		data, err := os.ReadFile(m.file)
+		if err != nil {
+			return err
+		}
+
+		if m.addr+len(data) > memSize {
+			return fmt.Errorf("%s doesn't fit at 0x%05x, %d bytes", m.file, m.addr, len(data))
+		}
+
+		copy(s.mem[m.addr:], data)
+		s.install(m.addr, len(data))
+		s.memHashValid = false
+	}
+
+	if s.decodeCache != nil {
+		s.decodeCache.reset()
+	}
+	if s.blocks != nil {
+		s.blocks.reset()
+	}
+
+	return nil
+}
+
+// `file`, or `file@addr:len` for a range
+func parseDumpSpec(spec string) (string, int, int, error) {
+	file, rangeStr, found := strings.Cut(spec, "@")
+	if !found {
+		return file, 0, memSize, nil
+	}
+
+	addrStr, lenStr, found := strings.Cut(rangeStr, ":")
+	if !found {
+		return "", 0, 0, fmt.Errorf("expected file@addr:len, got %s", spec)
+	}
+
+	addr, err := parseNumber(addrStr)
+	if err != nil || addr < 0 || addr >= memSize {
+		return "", 0, 0, fmt.Errorf("invalid address %s", addrStr)
+	}
+
+	length, err := parseNumber(lenStr)
+	if err != nil || length <= 0 || addr+length > memSize {
+		return "", 0, 0, fmt.Errorf("invalid length %s", lenStr)
+	}
+
+	return file, addr, length, nil
+}
+
+func (s *Sim) dumpMemory(spec string) error {
+	file, addr, length, err := parseDumpSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, s.mem[addr:addr+length], 0644)
+}
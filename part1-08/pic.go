@@ -0,0 +1,156 @@
+package main
+
+import "fmt"
+
+// 8259 programmable interrupt controller at ports 20h and 21h
+//
+// Only what a single PIC on the PC needs: the initialization sequence,
+// the mask, fixed priority with IRQ0 highest, non-specific and specific
+// EOI and reading IRR/ISR. It starts as left by the BIOS, vectors at 08h
+// and everything but IRQ0 masked.
+
+const (
+	picCommand = 0x20
+	picData    = 0x21
+)
+
+type PIC struct {
+	// vector of IRQ0, the others follow
+	base byte
+	// interrupt mask, request and in-service registers
+	imr, irr, isr byte
+
+	// next initialization word, 2 to 4, 0 when initialized
+	icw      int
+	single   bool
+	needICW4 bool
+	autoEOI  bool
+	readISR  bool
+}
+
+func newPIC() PIC {
+	return PIC{base: 0x08, imr: 0xfe}
+}
+
+// edge triggered, stays requested until acknowledged
+func (p *PIC) raise(irq int) {
+	p.irr |= 1 << irq
+}
+
+// highest priority unmasked request which isn't blocked by one in
+// service, -1 for none
+func (p *PIC) pending() int {
+	for irq := 0; irq < 8; irq++ {
+		bit := byte(1) << irq
+
+		if p.isr&bit != 0 {
+			return -1
+		}
+
+		if p.irr&bit != 0 && p.imr&bit == 0 {
+			return irq
+		}
+	}
+
+	return -1
+}
+
+// the cpu takes the interrupt, returns its vector
+func (p *PIC) acknowledge(irq int) byte {
+	p.irr &^= 1 << irq
+
+	if !p.autoEOI {
+		p.isr |= 1 << irq
+	}
+
+	return p.base + byte(irq)
+}
+
+// non-specific EOI, the highest priority in service
+func (p *PIC) endOfInterrupt() {
+	for irq := 0; irq < 8; irq++ {
+		if p.isr&(1<<irq) != 0 {
+			p.isr &^= 1 << irq
+			return
+		}
+	}
+}
+
+func (p *PIC) writeCommand(val byte) error {
+	switch true {
+	// ICW1
+	case val&0x10 != 0:
+		{
+			if val&0x08 != 0 {
+				return fmt.Errorf("pic: level triggered mode is not supported")
+			}
+
+			*p = PIC{base: p.base, icw: 2, single: val&0x02 != 0, needICW4: val&0x01 != 0}
+		}
+	// OCW3
+	case val&0x18 == 0x08:
+		{
+			if val&0x02 != 0 {
+				p.readISR = val&0x01 != 0
+			}
+		}
+	// OCW2
+	default:
+		{
+			switch val >> 5 {
+			case 0b001:
+				p.endOfInterrupt()
+			case 0b011:
+				p.isr &^= 1 << (val & 0b111)
+			default:
+				return fmt.Errorf("pic: priority rotation is not supported, ocw2 %02xh", val)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *PIC) writeData(val byte) {
+	switch p.icw {
+	case 2:
+		{
+			p.base = val & 0xf8
+
+			switch true {
+			case !p.single:
+				p.icw = 3
+			case p.needICW4:
+				p.icw = 4
+			default:
+				p.icw = 0
+			}
+		}
+	// cascading, nothing is attached
+	case 3:
+		{
+			p.icw = 0
+			if p.needICW4 {
+				p.icw = 4
+			}
+		}
+	case 4:
+		{
+			p.autoEOI = val&0x02 != 0
+			p.icw = 0
+		}
+	default:
+		p.imr = val
+	}
+}
+
+func (p *PIC) readCommand() byte {
+	if p.readISR {
+		return p.isr
+	}
+	return p.irr
+}
+
+func (p *PIC) readData() byte {
+	return p.imr
+}
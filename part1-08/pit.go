@@ -0,0 +1,228 @@
+package main
+
+import "fmt"
+
+// 8253 programmable interval timer at ports 40h-43h
+//
+// The PIT is clocked at 1.193182 MHz, a quarter of the 4.77 MHz CPU
+// clock, so one tick is 4 of our estimated clocks and timing follows the
+// clock estimate deterministically. Channel 0 raises IRQ0 on the 8259,
+// channels 1 and 2 can be programmed and read but drive nothing.
+//
+// Counting starts when the count is written, like the BIOS at boot
+// never ran, so programs that don't program the timer see no interrupts.
+// A new count takes effect immediately instead of at the end of the
+// current period.
+
+const (
+	pitTickClocks = 4
+
+	pitCounter0 = 0x40
+	pitControl  = 0x43
+)
+
+type PITChannel struct {
+	// 0 and 4 fire once, 2 and 3 periodically
+	mode byte
+	// 1 lsb, 2 msb, 3 lsb then msb
+	access byte
+	// 0 means 65536
+	reload uint16
+	// count is written and counting
+	armed bool
+	// tick the count was loaded at
+	start int
+	// mode 0 and 4 fired already
+	fired bool
+
+	// lsb of a two byte write is pending
+	writeHigh bool
+	// the next read returns the msb
+	readHigh bool
+
+	latched bool
+	latch   uint16
+}
+
+type PIT struct {
+	channels [3]PITChannel
+	// ticks already turned into interrupts
+	now int
+}
+
+func (c *PITChannel) period() int {
+	if c.reload == 0 {
+		return 0x10000
+	}
+	return int(c.reload)
+}
+
+// counter value at tick t
+func (c *PITChannel) count(t int) uint16 {
+	if !c.armed {
+		return c.reload
+	}
+
+	elapsed := t - c.start
+
+	switch c.mode {
+	case 2:
+		return uint16(c.period() - elapsed%c.period())
+	// counts down by two, twice per period
+	case 3:
+		return uint16(c.period() - (2*elapsed)%c.period())
+	}
+
+	// wraps around after the terminal count and keeps going
+	return uint16(c.period() - elapsed)
+}
+
+// number of rising edges of OUT in the ticks (from, to]
+func (c *PITChannel) edges(from, to int) int {
+	if !c.armed || to <= from {
+		return 0
+	}
+
+	p := c.period()
+
+	switch c.mode {
+	case 2, 3:
+		return max(0, (to-c.start)/p) - max(0, (from-c.start)/p)
+	}
+
+	if c.fired || c.start+p > to {
+		return 0
+	}
+
+	c.fired = true
+	return 1
+}
+
+// ticks from t to the next rising edge of OUT, -1 if there is none
+func (c *PITChannel) nextEdge(t int) int {
+	if !c.armed {
+		return -1
+	}
+
+	p := c.period()
+
+	switch c.mode {
+	case 2, 3:
+		return p - (t-c.start)%p
+	}
+
+	if c.fired {
+		return -1
+	}
+
+	return max(0, c.start+p-t)
+}
+
+// control word: channel (2) access (2) mode (3) bcd (1)
+func (p *PIT) writeControl(val byte) error {
+	idx := val >> 6
+	if idx == 3 {
+		return fmt.Errorf("pit: read-back command is 8254 only")
+	}
+
+	c := &p.channels[idx]
+	access := (val >> 4) & 0b11
+
+	// counter latch command
+	if access == 0 {
+		if !c.latched {
+			c.latched = true
+			c.latch = c.count(p.now)
+			c.readHigh = false
+		}
+		return nil
+	}
+
+	if val&1 == 1 {
+		return fmt.Errorf("pit: bcd counting is not supported")
+	}
+
+	mode := (val >> 1) & 0b111
+	// 6 and 7 are 2 and 3
+	if mode >= 6 {
+		mode -= 4
+	}
+
+	// 1 and 5 are triggered by the gate, which is not wired to anything
+	if mode == 1 || mode == 5 {
+		return fmt.Errorf("pit: mode %d is not supported", mode)
+	}
+
+	*c = PITChannel{mode: mode, access: access}
+	return nil
+}
+
+func (p *PIT) writeCounter(idx int, val byte) {
+	c := &p.channels[idx]
+
+	switch c.access {
+	case 1:
+		c.reload = uint16(val)
+	case 2:
+		c.reload = uint16(val) << 8
+	case 3:
+		{
+			if !c.writeHigh {
+				c.reload = c.reload&0xff00 | uint16(val)
+				c.writeHigh = true
+				// counting stops until the msb is written
+				c.armed = false
+				return
+			}
+
+			c.reload = c.reload&0x00ff | uint16(val)<<8
+			c.writeHigh = false
+		}
+	}
+
+	c.armed = true
+	c.start = p.now
+	c.fired = false
+}
+
+func (p *PIT) readCounter(idx int) byte {
+	c := &p.channels[idx]
+
+	val := c.count(p.now)
+	if c.latched {
+		val = c.latch
+	}
+
+	var result byte
+
+	switch c.access {
+	case 1:
+		result = byte(val)
+	case 2:
+		result = byte(val >> 8)
+	case 3:
+		{
+			if c.readHigh {
+				result = byte(val >> 8)
+			} else {
+				result = byte(val)
+			}
+			c.readHigh = !c.readHigh
+
+			// the latch holds until both bytes are read
+			if c.readHigh {
+				return result
+			}
+		}
+	}
+
+	c.latched = false
+	return result
+}
+
+// run to tick t, return whether channel 0 raised IRQ0
+func (p *PIT) advance(t int) bool {
+	edges := p.channels[0].edges(p.now, t)
+	p.now = max(p.now, t)
+	return edges > 0
+}
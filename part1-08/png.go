@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// memory as a framebuffer written to png files
+//
+// rgba takes 4 bytes per pixel in R, G, B, A order, indexed takes 1 byte
+// per pixel into the Plan 9 palette. With `-png-every N`, a frame is
+// written every N instructions next to the final image, e.g.
+// `out_000100.png` for `-png out.png`.
+
+type pngConfig struct {
+	file   string
+	addr   int
+	width  int
+	height int
+	// 8-bit indexed instead of rgba
+	indexed bool
+	// write a frame every n instructions, 0 for the final image only
+	every int
+}
+
+// `64x64`
+func parsePNGSize(str string) (int, int, error) {
+	wStr, hStr, found := strings.Cut(strings.ToLower(str), "x")
+	if !found {
+		return 0, 0, fmt.Errorf("expected WxH, got %s", str)
+	}
+
+	w, err := strconv.Atoi(wStr)
+	if err != nil || w <= 0 {
+		return 0, 0, fmt.Errorf("invalid width %s", wStr)
+	}
+
+	h, err := strconv.Atoi(hStr)
+	if err != nil || h <= 0 {
+		return 0, 0, fmt.Errorf("invalid height %s", hStr)
+	}
+
+	return w, h, nil
+}
+
+func newPNGConfig(file string, addr string, size string, format string, every int) (*pngConfig, error) {
+	result := &pngConfig{file: file, every: every}
+
+	var err error
+
+	result.addr, err = parseNumber(addr)
+	if err != nil || result.addr < 0 {
+		return nil, fmt.Errorf("invalid png address %s", addr)
+	}
+
+	result.width, result.height, err = parsePNGSize(size)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "rgba":
+	case "indexed":
+		result.indexed = true
+	default:
+		return nil, fmt.Errorf("unknown png format: %s", format)
+	}
+
+	if every < 0 {
+		return nil, fmt.Errorf("invalid png interval %d", every)
+	}
+
+	if result.addr+result.size() > memSize {
+		return nil, fmt.Errorf("png region 0x%05x + %d is out of memory", result.addr, result.size())
+	}
+
+	return result, nil
+}
+
+// bytes of the region
+func (c *pngConfig) size() int {
+	if c.indexed {
+		return c.width * c.height
+	}
+	return c.width * c.height * 4
+}
+
+// `out.png` to `out_000100.png`
+func (c *pngConfig) frameFile(count int) string {
+	base := strings.TrimSuffix(c.file, ".png")
+	return fmt.Sprintf("%s_%06d.png", base, count)
+}
+
+func (s *Sim) renderPNG(c *pngConfig) image.Image {
+	rect := image.Rect(0, 0, c.width, c.height)
+	region := s.mem[c.addr : c.addr+c.size()]
+
+	if c.indexed {
+		img := image.NewPaletted(rect, palette.Plan9)
+		copy(img.Pix, region)
+		return img
+	}
+
+	// non-premultiplied, the alpha byte is taken as is
+	img := image.NewNRGBA(rect)
+	copy(img.Pix, region)
+	return img
+}
+
+func (s *Sim) writePNG(c *pngConfig, fp string) error {
+	f, err := os.Create(fp)
+	if err != nil {
+		return err
+	}
+
+	if err := png.Encode(f, s.renderPNG(c)); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
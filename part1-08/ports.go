@@ -0,0 +1,52 @@
+package main
+
+// port i/o, see pit.go and pic.go
+//
+// Unconnected ports read as ff and ignore writes. A word access is two
+// byte accesses to port and port+1.
+
+func (s *Sim) portIn(port uint16, wide byte) (uint16, error) {
+	lo, err := s.portInByte(port)
+	if err != nil || wide == 0 {
+		return uint16(lo), err
+	}
+
+	hi, err := s.portInByte(port + 1)
+	return uint16(hi)<<8 | uint16(lo), err
+}
+
+func (s *Sim) portOut(port uint16, val uint16, wide byte) error {
+	if err := s.portOutByte(port, byte(val)); err != nil || wide == 0 {
+		return err
+	}
+
+	return s.portOutByte(port+1, byte(val>>8))
+}
+
+func (s *Sim) portInByte(port uint16) (byte, error) {
+	switch true {
+	case port == picCommand:
+		return s.pic.readCommand(), nil
+	case port == picData:
+		return s.pic.readData(), nil
+	case port >= pitCounter0 && port < pitControl:
+		return s.pit.readCounter(int(port - pitCounter0)), nil
+	}
+
+	return 0xff, nil
+}
+
+func (s *Sim) portOutByte(port uint16, val byte) error {
+	switch true {
+	case port == picCommand:
+		return s.pic.writeCommand(val)
+	case port == picData:
+		s.pic.writeData(val)
+	case port >= pitCounter0 && port < pitControl:
+		s.pit.writeCounter(int(port-pitCounter0), val)
+	case port == pitControl:
+		return s.pit.writeControl(val)
+	}
+
+	return nil
+}
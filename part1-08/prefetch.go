@@ -0,0 +1,161 @@
+package main
+
+// prefetch queue and bus timing model
+//
+// The bus interface unit (BIU) keeps fetching instruction bytes into the
+// queue, 4 clocks per bus cycle, while the execution unit (EU) runs. The
+// manual's clocks assume the instruction is already in the queue, so on
+// top of the additive estimate the EU stalls when
+//
+//   - instruction bytes are not fetched yet, e.g. after a jump flushed
+//     the queue or after a run of short instructions drained it
+//   - it needs the bus for a memory operand while a prefetch cycle is
+//     in progress
+//
+// and a long instruction lets the BIU fill the queue so the following
+// short ones run "free".
+//
+// This is an approximation: memory operands are transferred right after
+// the effective address calculation and a jump restarts fetching once
+// the EU finishes it.
+
+type Prefetcher struct {
+	is8088 bool
+
+	// bytes in the queue are [fetchAddr - queued, fetchAddr)
+	fetchAddr int
+	queued    int
+
+	// when the bus can start the next cycle
+	busTime int
+	// when the EU finished the last instruction
+	now int
+}
+
+const busCycleClocks = 4
+
+func newPrefetcher(is8088 bool) *Prefetcher {
+	return &Prefetcher{is8088: is8088}
+}
+
+func (p *Prefetcher) queueSize() int {
+	if p.is8088 {
+		return 4
+	}
+	return 6
+}
+
+// bytes the next prefetch cycle brings in, 0 if the queue has no room
+//
+// The 8086 fetches aligned words, so only one byte from an odd address,
+// and waits until there is room for a whole word.
+func (p *Prefetcher) fetchSize() int {
+	free := p.queueSize() - p.queued
+
+	if p.is8088 {
+		return min(free, 1)
+	}
+
+	if free < 2 {
+		return 0
+	}
+
+	return 2 - p.fetchAddr%2
+}
+
+// one prefetch cycle
+func (p *Prefetcher) fetch() {
+	n := p.fetchSize()
+	p.busTime += busCycleClocks
+	p.fetchAddr += n
+	p.queued += n
+}
+
+// run the prefetch cycles which complete by t
+func (p *Prefetcher) advance(t int) {
+	for {
+		// waits for room, which can't be earlier than t
+		if p.fetchSize() == 0 {
+			p.busTime = max(p.busTime, t)
+			return
+		}
+
+		if p.busTime+busCycleClocks > t {
+			return
+		}
+
+		p.fetch()
+	}
+}
+
+// the cycle in progress at t has to complete before anyone else uses the bus
+func (p *Prefetcher) finishCycle(t int) {
+	p.advance(t)
+
+	if p.busTime < t && p.fetchSize() > 0 {
+		p.fetch()
+	} else {
+		p.busTime = max(p.busTime, t)
+	}
+}
+
+// run one instruction at addr, return the stall clocks on top of the
+// additive estimate, `busCycles` are the EU's memory bus cycles
+func (p *Prefetcher) exec(addr int, size int, clocks Clocks, busCycles int, target int, taken bool) int {
+	start := p.now
+	p.advance(start)
+
+	// first instruction, or the queue doesn't hold the expected bytes
+	if p.fetchAddr-p.queued != addr {
+		p.queued = 0
+		p.fetchAddr = addr
+		p.busTime = max(p.busTime, start)
+	}
+
+	// wait for instruction bytes, the EU takes them as they arrive
+	t := start
+	need := size
+	for {
+		take := min(p.queued, need)
+		p.queued -= take
+		need -= take
+
+		if need == 0 {
+			break
+		}
+
+		// queue is empty, so there is room
+		p.fetch()
+		t = max(t, p.busTime)
+	}
+
+	stall := t - start
+
+	// memory operands, the EU waits for a prefetch cycle in progress
+	if busCycles > 0 {
+		request := t + clocks.ea
+		p.finishCycle(request)
+
+		stall += p.busTime - request
+		p.busTime += busCycles * busCycleClocks
+	}
+
+	finish := start + stall + clocks.total()
+
+	if taken {
+		// bytes in flight are thrown away with the queue
+		p.finishCycle(finish)
+		p.queued = 0
+		p.fetchAddr = target
+	}
+
+	p.now = finish
+
+	return stall
+}
+
+// an interrupt taken between instructions, like a jump without
+// instruction bytes of its own
+func (p *Prefetcher) interrupt(clocks Clocks, busCycles int, target int) int {
+	return p.exec(p.fetchAddr-p.queued, 0, clocks, busCycles, target, true)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// per instruction execution counts and estimated clocks
+//
+// Instructions are keyed by address, so the report decodes memory at
+// the end and self-modifying code shows the final bytes. Clocks of a
+// hardware interrupt count for the instruction it came after.
+
+// hot spots in the report
+const profileTop = 20
+
+type profileEntry struct {
+	count  int
+	clocks int
+}
+
+type Profile struct {
+	entries map[int]*profileEntry
+	count   int
+	clocks  int
+}
+
+func newProfile() *Profile {
+	return &Profile{entries: map[int]*profileEntry{}}
+}
+
+func (p *Profile) record(addr int, clocks int) {
+	e := p.entries[addr]
+	if e == nil {
+		e = &profileEntry{}
+		p.entries[addr] = e
+	}
+
+	e.count += 1
+	e.clocks += clocks
+	p.count += 1
+	p.clocks += clocks
+}
+
+func percent(part, total int) string {
+	if total == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(part)*100/float64(total))
+}
+
+// instruction at addr in memory, empty if it doesn't decode
+func (s *Sim) instructionText(addr int, f Formatter) (string, int) {
+	cmd, size, err := decodeOne(s.mem[addr:])
+	if err != nil {
+		return "", 0
+	}
+	return f.Format(cmd.Instruction()), size
+}
+
+// hot spots by clocks, then the annotated listing
+func (p *Profile) report(w io.Writer, s *Sim, prog *Program, f Formatter) {
+	addrs := make([]int, 0, len(p.entries))
+	for addr := range p.entries {
+		addrs = append(addrs, addr)
+	}
+
+	sort.Slice(addrs, func(i, j int) bool {
+		a, b := p.entries[addrs[i]], p.entries[addrs[j]]
+		if a.clocks != b.clocks {
+			return a.clocks > b.clocks
+		}
+		return addrs[i] < addrs[j]
+	})
+
+	fmt.Fprintf(w, "Profile: %d instructions, %d clocks\n", p.count, p.clocks)
+	fmt.Fprintf(w, "%10s %7s %10s %7s  addr  instruction\n", "clocks", "%", "count", "%")
+
+	for _, addr := range addrs[:min(len(addrs), profileTop)] {
+		e := p.entries[addr]
+		text, _ := s.instructionText(addr, f)
+		fmt.Fprintf(w, "%10d %7s %10d %7s  %04x  %s\n", e.clocks, percent(e.clocks, p.clocks), e.count, percent(e.count, p.count), addr, text)
+	}
+
+	if len(addrs) > profileTop {
+		fmt.Fprintf(w, "  ... %d more\n", len(addrs)-profileTop)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Annotated listing:")
+
+	if prog != nil {
+		fmt.Fprintf(w, "%10s %7s  line  source\n", "count", "clocks")
+		p.annotateSource(w, prog)
+	} else {
+		fmt.Fprintf(w, "%10s %7s  addr  instruction\n", "count", "clocks")
+		p.annotateMemory(w, s, f)
+	}
+}
+
+// count and clocks of the addresses in [start, end)
+func (p *Profile) sum(start, end int) (int, int) {
+	count, clocks := 0, 0
+
+	for addr := start; addr < end; addr++ {
+		if e := p.entries[addr]; e != nil {
+			count += e.count
+			clocks += e.clocks
+		}
+	}
+
+	return count, clocks
+}
+
+func (p *Profile) annotateLine(w io.Writer, count, clocks int, location string, text string) {
+	if count == 0 {
+		fmt.Fprintf(w, "%10s %7s  %s  %s\n", "", "", location, text)
+		return
+	}
+
+	fmt.Fprintf(w, "%10d %7s  %s  %s\n", count, percent(clocks, p.clocks), location, text)
+}
+
+// per source line, `times` lines add up their instructions
+func (p *Profile) annotateSource(w io.Writer, prog *Program) {
+	for _, l := range prog.lines {
+		count, clocks := p.sum(l.offset, l.offset+l.size)
+		p.annotateLine(w, count, clocks, fmt.Sprintf("%4d", l.line), l.text)
+	}
+}
+
+// linear disassembly of the loaded program
+func (p *Profile) annotateMemory(w io.Writer, s *Sim, f Formatter) {
+	for addr := 0; addr < s.initSize; {
+		text, size := s.instructionText(addr, f)
+		if size == 0 {
+			fmt.Fprintf(w, "%10s %7s  %04x  %s undecodable\n", "", "", addr, f.Comment())
+			return
+		}
+
+		count, clocks := p.sum(addr, addr+size)
+		p.annotateLine(w, count, clocks, fmt.Sprintf("%04x", addr), text)
+		addr += size
+	}
+}
@@ -9,6 +9,8 @@ import (
 type Flags struct {
 	zero bool
 	sign bool
+	// maskable interrupts are enabled, cleared at reset
+	interrupt bool
 }
 
 func (f *Flags) String() string {
@@ -20,13 +22,48 @@ func (f *Flags) String() string {
 	if f.sign {
 		result.WriteString("S")
 	}
+	if f.interrupt {
+		result.WriteString("I")
+	}
 
 	return result.String()
 }
 
+// bit positions in the flags register
+const (
+	Flag_Zero      = 6
+	Flag_Sign      = 7
+	Flag_Interrupt = 9
+)
+
+// the flags register as pushed by pushf
+func (f *Flags) word() uint16 {
+	var result uint16
+
+	if f.zero {
+		result |= 1 << Flag_Zero
+	}
+	if f.sign {
+		result |= 1 << Flag_Sign
+	}
+	if f.interrupt {
+		result |= 1 << Flag_Interrupt
+	}
+
+	return result
+}
+
+func (f *Flags) setWord(val uint16) {
+	f.zero = val&(1<<Flag_Zero) != 0
+	f.sign = val&(1<<Flag_Sign) != 0
+	f.interrupt = val&(1<<Flag_Interrupt) != 0
+}
+
 type Sim struct {
 	// ax, cx, dx, bx, sp, bp, si, di
-	regs  [8]uint16
+	regs [8]uint16
+	// es, cs, ss, ds
+	sregs [4]uint16
 	flags Flags
 
 	mem []byte
@@ -35,13 +72,72 @@ type Sim struct {
 	//
 	initSize    int
 	lastInsSize int
+
+	// memory reads and writes of the current instruction
+	memReads  []MemAccess
+	memWrites []MemChange
+
+	// estimated clocks of all executed instructions
+	totalClocks int
+	// 8-bit bus, every word transfer takes two bus cycles
+	is8088 bool
+	// prefetch queue model, nil for the additive estimate only
+	prefetch    *Prefetcher
+	totalStalls int
+
+	// checked after each instruction, see watch.go
+	watchpoints []*Watchpoint
+	nextWatchID int
+	// watchpoints triggered by the last instruction
+	watchHits []WatchHit
+
+	// text mode state of int 10h, see video.go
+	video Video
+
+	// devices on the ports, see ports.go
+	pit PIT
+	pic PIC
+	// vector table bytes written since the program was loaded over the
+	// table, a bit per byte, see interrupt.go
+	installed [vectorTableSize / 64]uint64
+
+	// hash of the memory for loop detection, see limit.go
+	memHash      uint64
+	memHashValid bool
+
+	// nil unless profiling, see profile.go
+	profile *Profile
+	// nil unless tracking coverage, see coverage.go
+	coverage *Coverage
+
+	// decoded instructions, nil to decode every step, see decodecache.go
+	decodeCache *DecodeCache
+	// the last decoded instruction without the cache
+	decoded Ins
+	// translated basic blocks, nil unless running them, see blocks.go
+	blocks *BlockEngine
+
+	// outcome of the last conditional jump or loop
+	branchTaken bool
+
+	// register and memory changes in the delta of every instruction, they
+	// are always there while watchpoints are set, on by default, a step
+	// only runs without allocating when it's off
+	trace bool
 }
 
+// 1MB, the whole 8086 address space
+const memSize = 1 << 20
+
 func newSim(instructions []byte) *Sim {
 	sim := &Sim{}
+	sim.video.mode = 3
+	sim.pic = newPIC()
+	sim.decodeCache = newDecodeCache()
+	sim.trace = true
 
 	sim.initSize = len(instructions)
-	sim.mem = make([]byte, max(sim.initSize, 4096))
+	sim.mem = make([]byte, max(sim.initSize, memSize))
 
 	// ip defaults to zero
 	copy(sim.mem, instructions)
@@ -49,249 +145,455 @@ func newSim(instructions []byte) *Sim {
 	return sim
 }
 
-func (s *Sim) disassemble() (Command, error) {
+// decode the instruction at ip, nil at the end
+//
+// The result points into the decode cache or the simulator and is only
+// valid until the next decode.
+func (s *Sim) decode() (*Ins, error) {
 	if s.ip >= s.initSize {
 		return nil, nil
 	}
 
+	if s.decodeCache != nil {
+		ins, err := s.decodeCache.lookup(s, s.ip)
+		if err != nil {
+			return nil, err
+		}
+
+		s.lastInsSize = ins.size
+		return ins, nil
+	}
+
 	r := newReader(s.mem[s.ip:])
 
-	bs := r.mustPeek(4)
-	firstByte := bs[0]
+	cmd, err := decodeCommand(r)
+	if err != nil {
+		return nil, err
+	}
 
-	var cmd Command
+	s.decoded = flatten(cmd, r.idx)
+	s.lastInsSize = r.idx
+	return &s.decoded, nil
+}
 
-	switch true {
-	case isMov(firstByte):
-		{
-			mov := parseMov(r)
+func (s *Sim) disassemble() (Command, error) {
+	ins, err := s.decode()
+	if err != nil || ins == nil {
+		return nil, err
+	}
 
-			if mov.typ == Mov_Invalid {
-				return nil, fmt.Errorf("invalid mov instruction: %#v", bs)
-			}
+	return ins.cmd, nil
+}
 
-			cmd = &mov
-		}
-	case isArithmetic(firstByte):
-		{
-			add := parseArithmetic(r)
+// decode and execute the instruction at ip, cmd is nil at the end
+func (s *Sim) step() (Command, Delta, error) {
+	ins, err := s.decode()
+	if err != nil || ins == nil {
+		return nil, Delta{}, err
+	}
 
-			if add.typ == Arithmetic_Invalid {
-				return nil, fmt.Errorf("invalid add instruction: %#v", bs)
-			}
-			cmd = &add
-		}
-	case isJumpOrLoop(firstByte):
-		{
-			j := JumpOrLoop{}
-			j.op = r.mustRead()
-			j.inc = r.mustReadInt8()
+	cmd := ins.cmd
+	delta, err := s.execIns(ins)
+	if err != nil {
+		return nil, Delta{}, err
+	}
 
-			cmd = &j
-		}
-	default:
-		{
-			return nil, fmt.Errorf("unknown instruction: %#v", bs)
-		}
+	return cmd, delta, nil
+}
+
+type RegChange struct {
+	// index into Sim.regs, or Sim.sregs for segment registers
+	reg      byte
+	seg      bool
+	old, new uint16
+}
+
+// always the whole register, e.g. `ax` for `mov ah, 1`
+func (r *RegChange) name() string {
+	if r.seg {
+		return SEGMENT_REGISTERS[r.reg]
 	}
+	return REGISTERS_16[r.reg]
+}
 
-	s.lastInsSize = r.idx
-	return cmd, nil
+type MemAccess struct {
+	addr int
+	wide byte
+}
+
+type MemChange struct {
+	addr     int
+	wide     byte
+	old, new uint16
 }
 
-func (s *Sim) exec(cmd Command) (string, error) {
-	oldSim := *s
-	var wide byte
+// state changes made by one instruction
+type Delta struct {
+	regs     []RegChange
+	oldIP    int
+	newIP    int
+	oldFlags Flags
+	newFlags Flags
+	mem      []MemChange
+	clocks   Clocks
+	// hardware interrupt taken after the instruction
+	irq    bool
+	vector byte
+}
+
+// e.g. `cx:0x3->0x2 ip:0x9->0xc flags:->Z`, memory writes by physical
+// address, e.g. `[0x3e8]:0x0->0x5`
+func (d *Delta) String() string {
+	var parts []string
+
+	for _, r := range d.regs {
+		parts = append(parts, fmt.Sprintf("%s:0x%x->0x%x", r.name(), r.old, r.new))
+	}
+
+	for _, m := range d.mem {
+		parts = append(parts, fmt.Sprintf("[0x%x]:0x%x->0x%x", m.addr, m.old, m.new))
+	}
+
+	parts = append(parts, fmt.Sprintf("ip:0x%x->0x%x", d.oldIP, d.newIP))
+
+	if d.irq {
+		parts = append(parts, fmt.Sprintf("irq:0x%x", d.vector))
+	}
+
+	if d.oldFlags != d.newFlags {
+		parts = append(parts, fmt.Sprintf("flags:%s->%s", d.oldFlags.String(), d.newFlags.String()))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// execute the instruction at ip
+//
+// Without tracing or watchpoints the delta only has ip, flags, clocks
+// and the interrupt, and the memory access lists are reused, so a step
+// doesn't allocate.
+func (s *Sim) execIns(decoded *Ins) (Delta, error) {
+	// the instruction may overwrite its own bytes, which clears the entry
+	// in the decode cache
+	ins := *decoded
+
+	old := s.beginIns()
+
 	var err error
 
-	switch v := cmd.(type) {
-	case *Mov:
-		{
-			m := cmd.(*Mov)
-			err = s.handleMov(m)
-			s.ip += s.lastInsSize
-			wide = m.w
-		}
-	case *Arithmetic:
-		{
-			a := cmd.(*Arithmetic)
-			err = s.handleArithmetic(a)
-			s.ip += s.lastInsSize
-			wide = a.w
-		}
-	case *JumpOrLoop:
-		{
-			j := cmd.(*JumpOrLoop)
-			s.ip += s.lastInsSize
-			s.handleJumpOrLoop(j)
-		}
-	default:
-		{
-			return "", fmt.Errorf("unsupported type: %v", v)
-		}
+	switch ins.kind {
+	case Ins_Mov:
+		err = s.handleMov(&ins)
+		s.ip += ins.size
+	case Ins_Arithmetic:
+		s.handleArithmetic(&ins)
+		s.ip += ins.size
+	case Ins_JumpOrLoop:
+		s.ip += ins.size
+		err = s.handleJumpOrLoop(&ins)
+	case Ins_Interrupt:
+		s.ip += ins.size
+		err = s.handleInterrupt(&ins)
+	case Ins_Stack:
+		s.handleStack(&ins)
+		s.ip += ins.size
+	case Ins_InOut:
+		err = s.handleInOut(&ins)
+		s.ip += ins.size
+	case Ins_Control:
+		err = s.handleControl(&ins)
+		s.ip += ins.size
 	}
 
 	if err != nil {
-		return "", err
+		return Delta{}, err
 	}
 
-	return s.getDebugInfo(&oldSim, wide), nil
+	return s.retireIns(&ins, &old)
 }
 
-func (s *Sim) getDebugInfo(oldS *Sim, wide byte) string {
-	output := &strings.Builder{}
+// state before an instruction, registers only when tracing
+type insState struct {
+	trace bool
+	ip    int
+	flags Flags
+	regs  [8]uint16
+	sregs [4]uint16
+}
 
-	// registers
-	{
+func (s *Sim) beginIns() insState {
+	old := insState{trace: s.trace || len(s.watchpoints) > 0, ip: s.ip, flags: s.flags}
 
-		for idx, old := range oldS.regs {
-			if old != s.regs[idx] {
-				output.WriteString(fmt.Sprintf("%s:0x%x->0x%x", regName(byte(idx), wide), old, s.regs[idx]))
-			}
-		}
+	// hits are of the last instruction, also once all watchpoints are gone
+	s.watchHits = s.watchHits[:0]
+
+	if old.trace {
+		old.regs, old.sregs = s.regs, s.sregs
+
+		// kept by the delta
+		s.memReads = nil
+		s.memWrites = nil
+	} else {
+		s.memReads = s.memReads[:0]
+		s.memWrites = s.memWrites[:0]
+	}
+
+	return old
+}
+
+// clocks, interrupts and bookkeeping after the instruction ran
+func (s *Sim) retireIns(ins *Ins, old *insState) (Delta, error) {
+	// a taken branch may go to the next instruction, e.g. `jz $+2`
+	taken := s.ip != old.ip+ins.size
+	if ins.isBranch() {
+		taken = s.branchTaken
 	}
 
-	// ip
-	{
-		output.WriteString(" ")
-		output.WriteString(fmt.Sprintf("ip:0x%x->0x%x", oldS.ip, s.ip))
+	clocks := ins.clocks
+	if taken && ins.isBranch() {
+		clocks = ins.takenClocks
 	}
+	clocks.penalty = s.busPenalty()
 
-	// flags
-	{
-		oldFlagsStr := oldS.flags.String()
-		flagsStr := s.flags.String()
-		if oldFlagsStr != flagsStr {
-			output.WriteString(" ")
-			output.WriteString(fmt.Sprintf("flgas:%s->%s", oldFlagsStr, flagsStr))
+	if ins.isHalt() {
+		clocks.wait = s.clocksToInterrupt(s.totalClocks + clocks.total())
+	}
+
+	if s.prefetch != nil {
+		busCycles := len(s.memReads) + len(s.memWrites) + clocks.penalty/4
+		clocks.stall = s.prefetch.exec(old.ip, ins.size, clocks, busCycles, s.ip, taken)
+		s.totalStalls += clocks.stall
+	}
+	s.totalClocks += clocks.total()
+
+	vector, irqClocks, err := s.serviceIRQ(ins)
+	if err != nil {
+		return Delta{}, err
+	}
+	clocks.irq = irqClocks
+
+	if s.profile != nil {
+		s.profile.record(old.ip, clocks.total())
+	}
+
+	if s.coverage != nil {
+		s.coverage.record(old.ip, ins.size, ins.isBranch(), taken)
+	}
+
+	delta := Delta{
+		oldIP:    old.ip,
+		newIP:    s.ip,
+		oldFlags: old.flags,
+		newFlags: s.flags,
+		clocks:   clocks,
+		irq:      vector >= 0,
+		vector:   byte(vector),
+	}
+
+	if old.trace {
+		s.addChanges(&delta, &old.regs, &old.sregs)
+	}
+
+	if len(s.watchpoints) > 0 {
+		s.checkWatchpoints(&delta)
+	}
+
+	return delta, nil
+}
+
+// register and memory changes of the delta
+func (s *Sim) addChanges(d *Delta, oldRegs *[8]uint16, oldSregs *[4]uint16) {
+	d.mem = s.memWrites
+
+	for idx, old := range oldRegs {
+		if old != s.regs[idx] {
+			d.regs = append(d.regs, RegChange{byte(idx), false, old, s.regs[idx]})
 		}
 	}
 
-	return output.String()
+	for idx, old := range oldSregs {
+		if old != s.sregs[idx] {
+			d.regs = append(d.regs, RegChange{byte(idx), true, old, s.sregs[idx]})
+		}
+	}
 }
 
-func (s *Sim) handleJumpOrLoop(j *JumpOrLoop) error {
-	switch j.op {
+func (s *Sim) handleJumpOrLoop(ins *Ins) error {
+	switch ins.op {
 	// jz
 	case 0b01110100:
-		{
-			if s.flags.zero {
-				s.ip += int(j.inc)
-			}
-		}
+		s.branchTaken = s.flags.zero
 		// jnz
 	case 0b01110101:
-		{
-			if !s.flags.zero {
-				s.ip += int(j.inc)
-			}
-		}
+		s.branchTaken = !s.flags.zero
 	default:
 		{
 			return errors.New("unsupported jumpOrLoop")
 		}
 	}
 
+	if s.branchTaken {
+		s.ip += int(ins.inc)
+	}
+
 	return nil
 }
 
-func (s *Sim) handleArithmetic(a *Arithmetic) error {
-	output := &strings.Builder{}
-	var result, target, source uint16
-	var sourceReg, targetReg byte
-	writeBack := true
+func (s *Sim) handleArithmetic(a *Ins) {
+	var target, source uint16
+	var targetOperand Operand
 
-	switch a.typ {
+	switch a.arithTyp {
 	case Arithmetic_Immediate_To_RegisterOrMemory:
 		{
-			assert(a.mod == 0b11, "only support register to register")
-			targetReg = a.rm
-			target = s.getReg(targetReg, a.w)
+			targetOperand = a.rmOperand(a.w)
 			source = a.data
 		}
 	case Arithmetic_RegOrMemory_With_Register_To_Either:
 		{
-			assert(a.mod == 0b11, "only support register to register")
-
-			sourceReg = a.reg
-			targetReg = a.rm
+			sourceOperand := registerOperand(a.reg, a.w)
+			targetOperand = a.rmOperand(a.w)
 			if a.d == 1 {
-				sourceReg, targetReg = targetReg, sourceReg
+				sourceOperand, targetOperand = targetOperand, sourceOperand
 			}
 
-			source = s.getReg(sourceReg, a.w)
-			target = s.getReg(targetReg, a.w)
-		}
-	}
-
-	switch a.op {
-	case Arithmetic_Cmp:
-		writeBack = false
-		fallthrough
-	case Arithmetic_Sub:
-		{
-			result = target - source
+			source = s.read(&sourceOperand)
 		}
-	case Arithmetic_Add:
+	case Arithmetic_Immediate_To_Accumulator:
 		{
-			result = target + source
+			targetOperand = registerOperand(0, a.w)
+			source = a.data
 		}
 	}
 
-	if writeBack {
-		output.WriteString(fmt.Sprintf("%s:0x%x->0x%x", regName(targetReg, a.w), target, result))
-		s.setReg(targetReg, result, a.w)
+	target = s.read(&targetOperand)
+
+	result := s.arith(a.arithOp, target, source, a.w)
+	if a.arithOp != Arithmetic_Cmp {
+		s.write(&targetOperand, result)
 	}
+}
 
-	prevFlags := s.flags.String()
+// add, sub or cmp of the w sized operands, sets the flags and returns the
+// result, cmp doesn't write it back
+func (s *Sim) arith(op ArithmeticOp, target, source uint16, w byte) uint16 {
+	result := target - source
+	if op == Arithmetic_Add {
+		result = target + source
+	}
 
-	if result == 0 {
-		s.flags.zero = true
+	if w == 0 {
+		result &= 0xff
 	}
 
-	s.flags.sign = result > 0x7fff
+	s.flags.zero = result == 0
+	s.flags.sign = result>>(8*w+7)&1 == 1
 
-	curFlags := s.flags.String()
+	return result
+}
 
-	if prevFlags != curFlags {
-		output.WriteString(" ")
-		output.WriteString(fmt.Sprintf("flags:%s->%s", prevFlags, curFlags))
+func (s *Sim) handleStack(ins *Ins) {
+	st := Stack{ins.op}
+
+	switch st.typ() {
+	// the 8086 pushes sp after the decrement
+	case Stack_Push_Register:
+		{
+			val := s.regs[st.reg()]
+			if st.reg() == 4 {
+				val -= 2
+			}
+			s.push(val)
+		}
+	case Stack_Pop_Register:
+		s.regs[st.reg()] = s.pop()
+	case Stack_Push_Segment:
+		s.push(s.sregs[st.reg()])
+	case Stack_Pop_Segment:
+		s.sregs[st.reg()] = s.pop()
+	case Stack_Pushf:
+		s.push(s.flags.word())
+	case Stack_Popf:
+		s.flags.setWord(s.pop())
+	}
+}
+
+func (s *Sim) push(val uint16) {
+	s.regs[4] -= 2
+	s.writeMem(s.physicalAddress(2, s.regs[4]), val, 1)
+}
+
+func (s *Sim) pop() uint16 {
+	result := s.readMem(s.physicalAddress(2, s.regs[4]), 1)
+	s.regs[4] += 2
+	return result
+}
+
+func (s *Sim) handleInOut(ins *Ins) error {
+	io := InOut{ins.op, ins.port}
+
+	port := uint16(io.port)
+	if io.isVariable() {
+		port = s.regs[2]
+	}
+
+	if io.isOut() {
+		return s.portOut(port, s.getReg(0, io.wide()), io.wide())
+	}
+
+	val, err := s.portIn(port, io.wide())
+	if err != nil {
+		return err
 	}
 
+	s.setReg(0, val, io.wide())
 	return nil
-	// return output.String(), nil
 }
 
-func (s *Sim) handleMov(m *Mov) error {
-	switch m.typ {
+func (s *Sim) handleMov(m *Ins) error {
+	switch m.movTyp {
 	case Mov_Immediate_To_Register:
 		{
-			// regName := m.regName(m.w)
-			// prev := s.getReg(m.reg, m.w)
 			s.setReg(m.reg, m.data, m.w)
 			return nil
-			// return fmt.Sprintf("%s:0x%x->0x%x", regName, prev, cur), nil
 		}
 	case Mov_RegisteryOrMemory_ToOrFrom_Register:
 		{
-			if m.mod != 0b11 {
-				break
-			}
-
-			sIdx := m.reg
-			dIdx := m.rm
-
+			source := registerOperand(m.reg, m.w)
+			target := m.rmOperand(m.w)
 			if m.d == 1 {
-				t := sIdx
-				sIdx = dIdx
-				dIdx = t
+				source, target = target, source
 			}
 
-			// regName := regName(dIdx, m.w)
-			// prev := s.getReg(dIdx, m.w)
-			s.setReg(dIdx, s.getReg(sIdx, m.w), m.w)
-
-			// return fmt.Sprintf("%s:0x%x->0x%x", regName, prev, cur), nil
+			s.write(&target, s.read(&source))
+			return nil
+		}
+	case Mov_RegisterOrMemory_To_Segment:
+		{
+			target, source := segmentOperand(m.reg&0b11), m.rmOperand(1)
+			s.write(&target, s.read(&source))
+			return nil
+		}
+	case Mov_Segment_To_RegisterOrMemory:
+		{
+			target, source := m.rmOperand(1), segmentOperand(m.reg&0b11)
+			s.write(&target, s.read(&source))
+			return nil
+		}
+	case Mov_Immediate_To_RegisterOrMemory:
+		{
+			target := m.rmOperand(m.w)
+			s.write(&target, m.data)
+			return nil
+		}
+	case Mov_Memory_To_Accumulator:
+		{
+			s.setReg(0, s.readMem(s.physicalAddress(3, m.data), m.w), m.w)
+			return nil
+		}
+	case Mov_Accumulator_To_Memory:
+		{
+			s.writeMem(s.physicalAddress(3, m.data), s.getReg(0, m.w), m.w)
 			return nil
 		}
 	}
@@ -299,6 +601,137 @@ func (s *Sim) handleMov(m *Mov) error {
 	return fmt.Errorf("unsupported mov type")
 }
 
+// physical address of a memory operand
+func (s *Sim) effectiveAddress(c *Common) int {
+	var addr uint16
+
+	// ds, or ss when bp is the base
+	var sr byte = 3
+	if c.rm == 0b010 || c.rm == 0b011 || (c.rm == 0b110 && c.mod != 0b00) {
+		sr = 2
+	}
+
+	switch c.rm {
+	case 0b000:
+		addr = s.regs[3] + s.regs[6] // bx + si
+	case 0b001:
+		addr = s.regs[3] + s.regs[7] // bx + di
+	case 0b010:
+		addr = s.regs[5] + s.regs[6] // bp + si
+	case 0b011:
+		addr = s.regs[5] + s.regs[7] // bp + di
+	case 0b100:
+		addr = s.regs[6] // si
+	case 0b101:
+		addr = s.regs[7] // di
+	case 0b110:
+		{
+			// direct address
+			if c.mod != 0b00 {
+				addr = s.regs[5] // bp
+			}
+		}
+	case 0b111:
+		addr = s.regs[3] // bx
+	}
+
+	addr += uint16(c.disp)
+
+	return s.physicalAddress(sr, addr)
+}
+
+// segment register index and offset to 20 bits address
+func (s *Sim) physicalAddress(sr byte, offset uint16) int {
+	return (int(s.sregs[sr])<<4 + int(offset)) % memSize
+}
+
+// read a register or memory operand
+func (s *Sim) read(o *Operand) uint16 {
+	if o.typ == Operand_Register {
+		return s.getReg(o.reg, o.wide)
+	}
+
+	if o.typ == Operand_SegmentRegister {
+		return s.sregs[o.reg]
+	}
+
+	assert(o.typ == Operand_Memory, "read: unsupported operand type %d", o.typ)
+	return s.readMem(s.effectiveAddress(&o.mem), o.wide)
+}
+
+// write a register or memory operand
+func (s *Sim) write(o *Operand, val uint16) {
+	if o.typ == Operand_Register {
+		s.setReg(o.reg, val, o.wide)
+		return
+	}
+
+	if o.typ == Operand_SegmentRegister {
+		s.sregs[o.reg] = val
+		return
+	}
+
+	assert(o.typ == Operand_Memory, "write: unsupported operand type %d", o.typ)
+	s.writeMem(s.effectiveAddress(&o.mem), val, o.wide)
+}
+
+// read memory as an instruction operand
+func (s *Sim) readMem(addr int, wide byte) uint16 {
+	s.memReads = append(s.memReads, MemAccess{addr % memSize, wide})
+	return s.peekMem(addr, wide)
+}
+
+// little endian, without bookkeeping
+func (s *Sim) peekMem(addr int, wide byte) uint16 {
+	result := uint16(s.mem[addr%memSize])
+
+	if wide == 1 {
+		result |= uint16(s.mem[(addr+1)%memSize]) << 8
+	}
+
+	return result
+}
+
+func (s *Sim) writeMem(addr int, val uint16, wide byte) {
+	old := s.peekMem(addr, wide)
+
+	s.pokeMem(addr, val, wide)
+
+	if wide == 0 {
+		val &= 0xff
+	}
+
+	s.memWrites = append(s.memWrites, MemChange{addr % memSize, wide, old, val})
+}
+
+// little endian, without bookkeeping
+func (s *Sim) pokeMem(addr int, val uint16, wide byte) {
+	s.pokeByte(addr%memSize, byte(val))
+
+	if wide == 1 {
+		s.pokeByte((addr+1)%memSize, byte(val>>8))
+	}
+
+	if addr%memSize < vectorTableSize {
+		s.install(addr%memSize, int(wide)+1)
+	}
+}
+
+func (s *Sim) pokeByte(addr int, b byte) {
+	if s.memHashValid {
+		s.memHash ^= memByteHash(addr, s.mem[addr]) ^ memByteHash(addr, b)
+	}
+
+	if s.decodeCache != nil {
+		s.decodeCache.invalidate(addr)
+	}
+	if s.blocks != nil {
+		s.blocks.invalidate(addr)
+	}
+
+	s.mem[addr] = b
+}
+
 // return new value of the whole register
 func (s *Sim) setReg(idx byte, val uint16, wide byte) uint16 {
 	assert(idx < 8, "getReg: register index must < 8, got %d", idx)
@@ -308,13 +741,12 @@ func (s *Sim) setReg(idx byte, val uint16, wide byte) uint16 {
 		return val
 	}
 
-	idx = idx % 4
-	r := s.regs[idx]
+	r := s.regs[idx%4]
 
 	// high part
 	if idx > 3 {
 		r = (r & 0x00ff) | (val << 8)
-		s.regs[idx] = r
+		s.regs[idx%4] = r
 		return r
 	}
 
@@ -342,9 +774,12 @@ func (s *Sim) getReg(idx byte, wide byte) uint16 {
 }
 
 func (s *Sim) dumpRegs() string {
-	b := new(strings.Builder)
+	return "Final registers:\n" + s.registerLines()
+}
 
-	b.WriteString("Final registers:\n")
+// non-zero registers and ip, one per line
+func (s *Sim) registerLines() string {
+	b := new(strings.Builder)
 
 	idxs := []int{0, 3, 1, 2, 4, 5, 6, 7}
 
@@ -355,11 +790,27 @@ func (s *Sim) dumpRegs() string {
 		}
 	}
 
+	for idx, val := range s.sregs {
+		if val != 0 {
+			b.WriteString(fmt.Sprintf("  %s: 0x%04x (%d)\n", SEGMENT_REGISTERS[idx], val, val))
+		}
+	}
+
 	b.WriteString(fmt.Sprintf("  ip: 0x%04x (%d)\n", s.ip, s.ip))
 
 	return b.String()
 }
 
+func (s *Sim) dumpClocks() string {
+	result := fmt.Sprintf("Total clocks: %d\n", s.totalClocks)
+
+	if s.prefetch != nil {
+		result += fmt.Sprintf("Total stalls: %d\n", s.totalStalls)
+	}
+
+	return result
+}
+
 func (s *Sim) dumpFlags() string {
 	b := new(strings.Builder)
 	b.WriteString("Flags: ")
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func assembleSource(t *testing.T, src string) *Program {
+	t.Helper()
+
+	prog, err := assemble(src)
+	if err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	return prog
+}
+
+// run to the end, return the delta of every instruction
+func runSim(t *testing.T, s *Sim) []Delta {
+	t.Helper()
+
+	var deltas []Delta
+	for {
+		cmd, delta, err := s.step()
+		if err != nil {
+			t.Fatalf("step at ip 0x%x: %v", s.ip, err)
+		}
+		if cmd == nil {
+			return deltas
+		}
+		deltas = append(deltas, delta)
+	}
+}
+
+// memory operands of mov and arithmetic, also past the first 4KB
+func TestExecMemoryOperands(t *testing.T) {
+	prog := assembleSource(t, `bits 16
+mov bx, 1000
+mov word [bx+2], 5
+mov ax, 7
+add [bx+2], ax
+mov cx, [bx+2]
+sub word [bx+2], 2
+mov [4000], ax
+mov ax, [1002]
+cmp word [bx+2], 10
+mov byte [60000], 0x7f
+mov dl, [60000]
+`)
+
+	s := newSim(prog.code)
+	runSim(t, s)
+
+	if got := s.readMem(1002, 1); got != 10 {
+		t.Errorf("[1002] = %d, want 10", got)
+	}
+	if got := s.readMem(4000, 1); got != 7 {
+		t.Errorf("[4000] = %d, want 7", got)
+	}
+	if ax, cx, dx := s.regs[0], s.regs[1], s.regs[2]; ax != 10 || cx != 12 || dx != 0x7f {
+		t.Errorf("ax, cx, dx = %d, %d, 0x%x, want 10, 12, 0x7f", ax, cx, dx)
+	}
+	if !s.flags.zero {
+		t.Error("ZF not set by cmp of a memory operand")
+	}
+}
+
+// the trace names the whole register, the same as the reference output,
+// and has the memory writes
+func TestDeltaString(t *testing.T) {
+	prog := assembleSource(t, "bits 16\nmov ah, 1\nsub ax, 256\nmov word [1000], 5\nadd byte [1000], 0xff\n")
+
+	got := []string{}
+	for _, d := range runSim(t, newSim(prog.code)) {
+		got = append(got, d.String())
+	}
+
+	want := []string{
+		"ax:0x0->0x100 ip:0x0->0x2",
+		"ax:0x100->0x0 ip:0x2->0x5 flags:->Z",
+		"[0x3e8]:0x0->0x5 ip:0x5->0xb",
+		"[0x3e8]:0x5->0x4 ip:0xb->0x10 flags:Z->",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// ZF clears after a non-zero result, SF is the top bit of the operand size
+func TestArithmeticFlags(t *testing.T) {
+	prog := assembleSource(t, `bits 16
+mov ax, 1
+sub ax, 1
+add ax, 2
+mov bl, 0x7f
+add bl, 1
+sub bx, 1
+`)
+
+	want := []struct{ zero, sign bool }{
+		{false, false},
+		{true, false},
+		{false, false},
+		{false, false},
+		{false, true},
+		{false, false},
+	}
+
+	deltas := runSim(t, newSim(prog.code))
+	if len(deltas) != len(want) {
+		t.Fatalf("%d instructions, want %d", len(deltas), len(want))
+	}
+
+	for i, d := range deltas {
+		if d.newFlags.zero != want[i].zero || d.newFlags.sign != want[i].sign {
+			t.Errorf("instruction %d: flags %s, want ZF %v SF %v", i, d.newFlags.String(), want[i].zero, want[i].sign)
+		}
+	}
+}
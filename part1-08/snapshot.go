@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// machine state saved to a json file and loaded back
+//
+// Memory is stored as the non-zero 4KB pages, base64 encoded. Debugger
+// state like breakpoints and watchpoints is not part of the machine.
+// `version` changes with incompatible formats, unknown ones are rejected.
+
+const snapshotVersion = 1
+
+const snapshotPageSize = 4096
+
+type Snapshot struct {
+	Version int    `json:"version"`
+	CPU     string `json:"cpu"`
+
+	Regs  map[string]uint16 `json:"regs"`
+	Sregs map[string]uint16 `json:"sregs"`
+	// as pushed by pushf
+	Flags uint16 `json:"flags"`
+	IP    int    `json:"ip"`
+
+	// size of the loaded program, execution ends at it
+	CodeSize int              `json:"codeSize"`
+	Memory   []snapshotMemory `json:"memory"`
+
+	TotalClocks int `json:"totalClocks"`
+	TotalStalls int `json:"totalStalls"`
+	// nil without the prefetch queue model
+	Prefetch *snapshotPrefetch `json:"prefetch,omitempty"`
+	// int 10h state, the text buffer itself is in memory
+	Video *snapshotVideo `json:"video,omitempty"`
+	// nil before device support, the power on state is used
+	Devices *snapshotDevices `json:"devices,omitempty"`
+}
+
+type snapshotMemory struct {
+	Addr int    `json:"addr"`
+	Data string `json:"data"`
+}
+
+type snapshotVideo struct {
+	Mode byte `json:"mode"`
+	Row  int  `json:"row"`
+	Col  int  `json:"col"`
+}
+
+type snapshotDevices struct {
+	PIT    [3]snapshotPITChannel `json:"pit"`
+	PITNow int                   `json:"pitNow"`
+	PIC    snapshotPIC           `json:"pic"`
+	// vector table entries in use, see interrupt.go
+	Vectors []int `json:"vectors,omitempty"`
+	// written bytes of the entries which are only written in part
+	VectorBytes []int `json:"vectorBytes,omitempty"`
+}
+
+type snapshotPITChannel struct {
+	Mode      byte   `json:"mode"`
+	Access    byte   `json:"access"`
+	Reload    uint16 `json:"reload"`
+	Armed     bool   `json:"armed"`
+	Start     int    `json:"start"`
+	Fired     bool   `json:"fired"`
+	WriteHigh bool   `json:"writeHigh"`
+	ReadHigh  bool   `json:"readHigh"`
+	Latched   bool   `json:"latched"`
+	Latch     uint16 `json:"latch"`
+}
+
+type snapshotPIC struct {
+	Base     byte `json:"base"`
+	IMR      byte `json:"imr"`
+	IRR      byte `json:"irr"`
+	ISR      byte `json:"isr"`
+	ICW      int  `json:"icw"`
+	Single   bool `json:"single"`
+	NeedICW4 bool `json:"needICW4"`
+	AutoEOI  bool `json:"autoEOI"`
+	ReadISR  bool `json:"readISR"`
+}
+
+func (s *Sim) snapshotDevices() *snapshotDevices {
+	result := &snapshotDevices{PITNow: s.pit.now}
+
+	for idx, c := range s.pit.channels {
+		result.PIT[idx] = snapshotPITChannel{c.mode, c.access, c.reload, c.armed, c.start, c.fired, c.writeHigh, c.readHigh, c.latched, c.latch}
+	}
+
+	p := s.pic
+	result.PIC = snapshotPIC{p.base, p.imr, p.irr, p.isr, p.icw, p.single, p.needICW4, p.autoEOI, p.readISR}
+
+	for vector := 0; vector < 256; vector++ {
+		if s.isInstalled(byte(vector)) {
+			result.Vectors = append(result.Vectors, vector)
+			continue
+		}
+
+		for addr := vector * 4; addr < vector*4+4; addr++ {
+			if s.installed[addr/64]&(1<<(addr%64)) != 0 {
+				result.VectorBytes = append(result.VectorBytes, addr)
+			}
+		}
+	}
+
+	return result
+}
+
+func (d *snapshotDevices) state() (PIT, PIC, [vectorTableSize / 64]uint64, error) {
+	pit := PIT{now: d.PITNow}
+	for idx, c := range d.PIT {
+		pit.channels[idx] = PITChannel{c.Mode, c.Access, c.Reload, c.Armed, c.Start, c.Fired, c.WriteHigh, c.ReadHigh, c.Latched, c.Latch}
+	}
+
+	p := d.PIC
+	pic := PIC{p.Base, p.IMR, p.IRR, p.ISR, p.ICW, p.Single, p.NeedICW4, p.AutoEOI, p.ReadISR}
+
+	var installed [vectorTableSize / 64]uint64
+	for _, vector := range d.Vectors {
+		if vector < 0 || vector > 255 {
+			return PIT{}, PIC{}, installed, fmt.Errorf("invalid vector %d", vector)
+		}
+		installed[vector*4/64] |= 0xf << (vector * 4 % 64)
+	}
+
+	for _, addr := range d.VectorBytes {
+		if addr < 0 || addr >= vectorTableSize {
+			return PIT{}, PIC{}, installed, fmt.Errorf("invalid vector table byte %d", addr)
+		}
+		installed[addr/64] |= 1 << (addr % 64)
+	}
+
+	return pit, pic, installed, nil
+}
+
+type snapshotPrefetch struct {
+	FetchAddr int `json:"fetchAddr"`
+	Queued    int `json:"queued"`
+	BusTime   int `json:"busTime"`
+	Now       int `json:"now"`
+}
+
+func (s *Sim) snapshot() *Snapshot {
+	result := &Snapshot{
+		Version:     snapshotVersion,
+		CPU:         "8086",
+		Regs:        map[string]uint16{},
+		Sregs:       map[string]uint16{},
+		Flags:       s.flags.word(),
+		IP:          s.ip,
+		CodeSize:    s.initSize,
+		TotalClocks: s.totalClocks,
+		TotalStalls: s.totalStalls,
+		Video:       &snapshotVideo{s.video.mode, s.video.row, s.video.col},
+		Devices:     s.snapshotDevices(),
+	}
+
+	if s.is8088 {
+		result.CPU = "8088"
+	}
+
+	for idx, name := range REGISTERS_16 {
+		result.Regs[name] = s.regs[idx]
+	}
+	for idx, name := range SEGMENT_REGISTERS {
+		result.Sregs[name] = s.sregs[idx]
+	}
+
+	for addr := 0; addr < memSize; addr += snapshotPageSize {
+		page := s.mem[addr : addr+snapshotPageSize]
+
+		empty := true
+		for _, b := range page {
+			if b != 0 {
+				empty = false
+				break
+			}
+		}
+
+		if !empty {
+			result.Memory = append(result.Memory, snapshotMemory{addr, base64.StdEncoding.EncodeToString(page)})
+		}
+	}
+
+	if p := s.prefetch; p != nil {
+		result.Prefetch = &snapshotPrefetch{p.fetchAddr, p.queued, p.busTime, p.now}
+	}
+
+	return result
+}
+
+// replace the machine state, watchpoints are kept
+func (s *Sim) restore(snap *Snapshot) error {
+	if snap.Version < 1 || snap.Version > snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+
+	if snap.CPU != "8086" && snap.CPU != "8088" {
+		return fmt.Errorf("unknown cpu %s", snap.CPU)
+	}
+
+	if snap.CodeSize < 0 || snap.CodeSize > memSize {
+		return fmt.Errorf("code size %d is out of range", snap.CodeSize)
+	}
+
+	// at the end of the code the program is finished
+	if snap.IP < 0 || snap.IP > snap.CodeSize {
+		return fmt.Errorf("ip 0x%05x is out of the code", snap.IP)
+	}
+
+	if p := snap.Prefetch; p != nil {
+		queueSize := (&Prefetcher{is8088: snap.CPU == "8088"}).queueSize()
+		if p.Queued < 0 || p.Queued > queueSize || p.FetchAddr < p.Queued || p.FetchAddr > memSize {
+			return fmt.Errorf("prefetch queue of %d bytes up to 0x%05x is out of range", p.Queued, p.FetchAddr)
+		}
+	}
+
+	mem := make([]byte, memSize)
+	for _, m := range snap.Memory {
+		data, err := base64.StdEncoding.DecodeString(m.Data)
+		if err != nil {
+			return fmt.Errorf("invalid memory at 0x%05x: %w", m.Addr, err)
+		}
+
+		if m.Addr < 0 || m.Addr+len(data) > memSize {
+			return fmt.Errorf("memory at 0x%05x is out of range", m.Addr)
+		}
+
+		copy(mem[m.Addr:], data)
+	}
+
+	var regs [8]uint16
+	for name, val := range snap.Regs {
+		idx := indexOf(REGISTERS_16, name)
+		if idx < 0 {
+			return fmt.Errorf("unknown register %s", name)
+		}
+		regs[idx] = val
+	}
+
+	var sregs [4]uint16
+	for name, val := range snap.Sregs {
+		idx := indexOf(SEGMENT_REGISTERS, name)
+		if idx < 0 {
+			return fmt.Errorf("unknown segment register %s", name)
+		}
+		sregs[idx] = val
+	}
+
+	// snapshots before video support
+	video := Video{mode: 3}
+	if v := snap.Video; v != nil {
+		if v.Mode != 3 && v.Mode != 7 {
+			return fmt.Errorf("unsupported video mode %d", v.Mode)
+		}
+		if v.Row < 0 || v.Row >= textRows || v.Col < 0 || v.Col >= textColumns {
+			return fmt.Errorf("cursor %d,%d is out of the screen", v.Row, v.Col)
+		}
+		video = Video{v.Mode, v.Row, v.Col}
+	}
+
+	pit, pic, installed := PIT{}, newPIC(), [vectorTableSize / 64]uint64{}
+	if d := snap.Devices; d != nil {
+		var err error
+		if pit, pic, installed, err = d.state(); err != nil {
+			return err
+		}
+	}
+
+	s.regs = regs
+	s.sregs = sregs
+	s.flags.setWord(snap.Flags)
+	s.ip = snap.IP
+	s.initSize = snap.CodeSize
+	s.mem = mem
+	s.memHashValid = false
+	if s.decodeCache != nil {
+		s.decodeCache.reset()
+	}
+	if s.blocks != nil {
+		s.blocks.reset()
+	}
+	s.lastInsSize = 0
+	s.memReads = nil
+	s.memWrites = nil
+	s.totalClocks = snap.TotalClocks
+	s.totalStalls = snap.TotalStalls
+	s.is8088 = snap.CPU == "8088"
+	s.video = video
+	s.pit = pit
+	s.pic = pic
+	s.installed = installed
+
+	s.prefetch = nil
+	if p := snap.Prefetch; p != nil {
+		s.prefetch = &Prefetcher{s.is8088, p.FetchAddr, p.Queued, p.BusTime, p.Now}
+	}
+
+	return nil
+}
+
+func saveSnapshot(fp string, s *Sim) error {
+	data, err := json.MarshalIndent(s.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fp, append(data, '\n'), 0644)
+}
+
+// restore the file into s
+func loadSnapshot(fp string, s *Sim) error {
+	data, err := os.ReadFile(fp)
+	if err != nil {
+		return err
+	}
+
+	snap := &Snapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return fmt.Errorf("invalid snapshot %s: %w", fp, err)
+	}
+
+	if err := s.restore(snap); err != nil {
+		return fmt.Errorf("invalid snapshot %s: %w", fp, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	prog := assembleSource(t, "bits 16\nmov bx, 1000\nmov word [bx], 7\nadd bx, 1\n")
+
+	s := newSim(prog.code)
+	s.prefetch = newPrefetcher(false)
+	if _, _, err := s.step(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.step(); err != nil {
+		t.Fatal(err)
+	}
+
+	fp := filepath.Join(t.TempDir(), "snap.json")
+	if err := saveSnapshot(fp, s); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newSim(nil)
+	if err := loadSnapshot(fp, loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.stateHash() != s.stateHash() || *loaded.prefetch != *s.prefetch {
+		t.Fatalf("loaded state differs")
+	}
+
+	runSim(t, loaded)
+	if bx := loaded.regs[3]; bx != 1001 {
+		t.Errorf("bx = %d after running the loaded snapshot, want 1001", bx)
+	}
+}
+
+// a corrupt snapshot is an error, not a panic on the next step
+func TestSnapshotCorrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(snap *Snapshot)
+		err     string
+	}{
+		{"negative ip", func(snap *Snapshot) { snap.IP = -1 }, "ip"},
+		{"ip past the code", func(snap *Snapshot) { snap.IP = snap.CodeSize + 1 }, "ip"},
+		{"negative code size", func(snap *Snapshot) { snap.CodeSize = -1 }, "code size"},
+		{"code size past memory", func(snap *Snapshot) { snap.CodeSize = memSize + 1 }, "code size"},
+		{"negative queue", func(snap *Snapshot) { snap.Prefetch.Queued = -1 }, "prefetch"},
+		{"queue too long", func(snap *Snapshot) { snap.Prefetch.Queued = 7 }, "prefetch"},
+		{"fetch past memory", func(snap *Snapshot) { snap.Prefetch.FetchAddr = memSize + 1 }, "prefetch"},
+		{"negative fetch", func(snap *Snapshot) { snap.Prefetch.FetchAddr = -1 }, "prefetch"},
+	}
+
+	prog := assembleSource(t, "bits 16\nmov ax, 1\nmov bx, 2\n")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSim(prog.code)
+			s.prefetch = newPrefetcher(false)
+
+			snap := s.snapshot()
+			tt.corrupt(snap)
+
+			data, err := json.Marshal(snap)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fp := filepath.Join(t.TempDir(), "snap.json")
+			if err := os.WriteFile(fp, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err = loadSnapshot(fp, s)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want one about the %s", err, tt.err)
+			}
+
+			// the machine is left as it was
+			runSim(t, s)
+		})
+	}
+}
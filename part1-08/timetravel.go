@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// reverse execution in the debugger
+//
+// Every executed instruction is kept in the debugger's history with its
+// delta, which has the old values of everything the instruction changed,
+// so undoing deltas from the most recent one walks the state back.
+
+// revert an executed instruction, deltas have to be undone most recent first
+func (s *Sim) undo(d *Delta) {
+	for i := len(d.mem) - 1; i >= 0; i-- {
+		m := d.mem[i]
+		s.pokeMem(m.addr, m.old, m.wide)
+	}
+
+	for _, r := range d.regs {
+		if r.seg {
+			s.sregs[r.reg] = r.old
+		} else {
+			s.regs[r.reg] = r.old
+		}
+	}
+
+	s.flags = d.oldFlags
+	s.ip = d.oldIP
+
+	s.totalClocks -= d.clocks.total()
+	s.totalStalls -= d.clocks.stall
+}
+
+// number of executed instructions
+func (d *Debugger) count() int {
+	return d.dropped + len(d.history)
+}
+
+// undo the most recent instruction, return false at the start of history
+func (d *Debugger) undo() (historyEntry, bool) {
+	if len(d.history) == 0 {
+		return historyEntry{}, false
+	}
+
+	entry := d.history[len(d.history)-1]
+	d.history = d.history[:len(d.history)-1]
+
+	d.sim.undo(&entry.delta)
+	if d.sim.prefetch != nil {
+		*d.sim.prefetch = entry.prefetch
+	}
+	d.sim.pit.now = entry.pitNow
+	if dev := entry.devices; dev != nil {
+		d.sim.video = dev.video
+		d.sim.pit.channels = dev.channels
+		d.sim.pic = dev.pic
+		d.sim.installed = dev.installed
+	}
+	d.done = false
+
+	return entry, true
+}
+
+// where reverse execution stops when the history runs out
+func (d *Debugger) printStart() {
+	if d.dropped > 0 {
+		d.printf("history starts at instruction %d\n", d.dropped)
+	} else {
+		d.printf("at the start of the program\n")
+	}
+}
+
+func (d *Debugger) cmdReverseStep(args []string) error {
+	n := 1
+	if len(args) > 0 {
+		v, err := parseNumber(args[0])
+		if err != nil || v <= 0 {
+			return fmt.Errorf("invalid count %s", args[0])
+		}
+		n = v
+	}
+
+	for i := 0; i < n; i++ {
+		entry, ok := d.undo()
+		if !ok {
+			d.printStart()
+			break
+		}
+
+		d.printf("undo %s ; %s\n", d.formatEntry(&entry), entry.delta.String())
+	}
+
+	d.printNext()
+	return nil
+}
+
+func (d *Debugger) cmdReverseContinue() {
+	count := 0
+
+	for {
+		if _, ok := d.undo(); !ok {
+			d.printStart()
+			break
+		}
+		count += 1
+
+		if bp := d.breakpoints[d.sim.ip]; bp != nil && (bp.cond == nil || bp.cond(d.sim) != 0) {
+			d.printf("breakpoint at %s, ", d.formatOffset(d.sim.ip))
+			break
+		}
+	}
+
+	d.printf("undid %d instructions\n", count)
+	d.printNext()
+}
+
+// undo until the instruction whose delta matches, it's the next to execute
+func (d *Debugger) cmdLastWrite(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: lastwrite <reg|flags|addr>")
+	}
+
+	match, err := d.writeMatcher(args[0])
+	if err != nil {
+		return err
+	}
+
+	count := 0
+
+	for {
+		entry, ok := d.undo()
+		if !ok {
+			d.printStart()
+			d.printf("no write to %s found, undid %d instructions\n", args[0], count)
+			break
+		}
+		count += 1
+
+		if match(&entry.delta) {
+			d.printf("%s written by instruction %d, undid %d instructions\n", args[0], d.count()+1, count)
+			d.printf("%s ; %s\n", d.formatEntry(&entry), entry.delta.String())
+			break
+		}
+	}
+
+	d.printNext()
+	return nil
+}
+
+// whether a delta changes the register, flags or memory address
+func (d *Debugger) writeMatcher(str string) (func(*Delta) bool, error) {
+	name := strings.ToLower(str)
+
+	if name == "flags" {
+		return func(delta *Delta) bool { return delta.oldFlags != delta.newFlags }, nil
+	}
+
+	if reg, seg := registerIndex(name); reg >= 0 {
+		return func(delta *Delta) bool {
+			for _, r := range delta.regs {
+				if int(r.reg) == reg && r.seg == seg {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	addr, err := d.parseAddress(str)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(delta *Delta) bool {
+		for _, m := range delta.mem {
+			if m.addr == addr || (m.wide == 1 && (m.addr+1)%memSize == addr) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// go to the state after n instructions
+func (d *Debugger) cmdGoto(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: goto <n>")
+	}
+
+	n, err := parseNumber(args[0])
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid instruction count %s", args[0])
+	}
+
+	if n < d.dropped {
+		return fmt.Errorf("history starts at instruction %d", d.dropped)
+	}
+
+	for d.count() > n {
+		d.undo()
+	}
+
+	for d.count() < n {
+		ok, err := d.step()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+	}
+
+	d.printf("at instruction %d\n", d.count())
+	d.printNext()
+	return nil
+}
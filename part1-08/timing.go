@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+)
+
+// clock estimation from the 8086 manual, table 2-20 and 2-21
+
+type Clocks struct {
+	base int
+	// effective address calculation
+	ea int
+	// word transfers on the 8088, or at odd addresses on the 8086
+	penalty int
+	// waiting for the prefetch queue or the bus, see prefetch.go
+	stall int
+	// hlt waiting for an interrupt
+	wait int
+	// taking a hardware interrupt after the instruction, see interrupt.go
+	irq int
+}
+
+func (c Clocks) total() int {
+	return c.base + c.ea + c.penalty + c.stall + c.wait + c.irq
+}
+
+// breakdown of the total, e.g. ` (9 + 5ea + 4p)`, empty if there is nothing to add up
+func (c Clocks) detail() string {
+	if c.ea == 0 && c.penalty == 0 && c.stall == 0 && c.wait == 0 && c.irq == 0 {
+		return ""
+	}
+
+	result := fmt.Sprintf(" (%d", c.base)
+
+	if c.ea != 0 {
+		result += fmt.Sprintf(" + %dea", c.ea)
+	}
+	if c.penalty != 0 {
+		result += fmt.Sprintf(" + %dp", c.penalty)
+	}
+	if c.stall != 0 {
+		result += fmt.Sprintf(" + %dstall", c.stall)
+	}
+	if c.wait != 0 {
+		result += fmt.Sprintf(" + %dwait", c.wait)
+	}
+	if c.irq != 0 {
+		result += fmt.Sprintf(" + %dirq", c.irq)
+	}
+
+	return result + ")"
+}
+
+// 4 clocks for each extra bus cycle of the current instruction's word
+// transfers, the 8088 always needs two and the 8086 needs two when the
+// address is odd
+func (s *Sim) busPenalty() int {
+	result := 0
+
+	penalty := func(addr int, wide byte) {
+		if wide == 1 && (s.is8088 || addr%2 == 1) {
+			result += 4
+		}
+	}
+
+	for _, r := range s.memReads {
+		penalty(r.addr, r.wide)
+	}
+	for _, w := range s.memWrites {
+		penalty(w.addr, w.wide)
+	}
+
+	return result
+}
+
+// `taken` is for conditional jumps and loops
+func estimateClocks(cmd Command, taken bool) Clocks {
+	switch c := cmd.(type) {
+	case *Mov:
+		return movClocks(c)
+	case *Arithmetic:
+		return arithmeticClocks(c)
+	case *JumpOrLoop:
+		return jumpClocks(c, taken)
+	case *Interrupt:
+		{
+			if c.isReturn() {
+				return Clocks{base: 24}
+			}
+			// an emulated BIOS routine itself is not counted
+			return Clocks{base: 51}
+		}
+	case *Stack:
+		return stackClocks(c)
+	case *InOut:
+		{
+			if c.isVariable() {
+				return Clocks{base: 8}
+			}
+			return Clocks{base: 10}
+		}
+	case *Control:
+		return Clocks{base: 2}
+	}
+
+	panic("unreachable")
+}
+
+func movClocks(m *Mov) Clocks {
+	switch m.typ {
+	case Mov_Memory_To_Accumulator, Mov_Accumulator_To_Memory:
+		return Clocks{base: 10}
+	case Mov_Immediate_To_Register:
+		return Clocks{base: 4}
+	case Mov_Immediate_To_RegisterOrMemory:
+		{
+			if m.mod == 0b11 {
+				return Clocks{base: 4}
+			}
+			return Clocks{base: 10, ea: eaClocks(&m.Common)}
+		}
+	}
+
+	// register/memory to/from register, including segment registers
+	if m.mod == 0b11 {
+		return Clocks{base: 2}
+	}
+
+	toMemory := m.typ == Mov_Segment_To_RegisterOrMemory ||
+		(m.typ == Mov_RegisteryOrMemory_ToOrFrom_Register && m.d == 0)
+
+	if toMemory {
+		return Clocks{base: 9, ea: eaClocks(&m.Common)}
+	}
+
+	return Clocks{base: 8, ea: eaClocks(&m.Common)}
+}
+
+func arithmeticClocks(a *Arithmetic) Clocks {
+	switch a.typ {
+	case Arithmetic_Immediate_To_Accumulator:
+		return Clocks{base: 4}
+	case Arithmetic_Immediate_To_RegisterOrMemory:
+		{
+			if a.mod == 0b11 {
+				return Clocks{base: 4}
+			}
+
+			// cmp doesn't write back
+			if a.op == Arithmetic_Cmp {
+				return Clocks{base: 10, ea: eaClocks(&a.Common)}
+			}
+			return Clocks{base: 17, ea: eaClocks(&a.Common)}
+		}
+	}
+
+	if a.mod == 0b11 {
+		return Clocks{base: 3}
+	}
+
+	// memory destination
+	if a.d == 0 && a.op != Arithmetic_Cmp {
+		return Clocks{base: 16, ea: eaClocks(&a.Common)}
+	}
+
+	return Clocks{base: 9, ea: eaClocks(&a.Common)}
+}
+
+func jumpClocks(j *JumpOrLoop, taken bool) Clocks {
+	// taken, not taken
+	clocks := [2]int{16, 4}
+
+	switch j.opName() {
+	case "loop":
+		clocks = [2]int{17, 5}
+	case "loopz":
+		clocks = [2]int{18, 6}
+	case "loopnz":
+		clocks = [2]int{19, 5}
+	case "jcxz":
+		clocks = [2]int{18, 6}
+	}
+
+	if taken {
+		return Clocks{base: clocks[0]}
+	}
+	return Clocks{base: clocks[1]}
+}
+
+func stackClocks(st *Stack) Clocks {
+	switch st.typ() {
+	case Stack_Push_Register:
+		return Clocks{base: 11}
+	case Stack_Push_Segment, Stack_Pushf:
+		return Clocks{base: 10}
+	}
+
+	return Clocks{base: 8}
+}
+
+// effective address calculation clocks
+func eaClocks(c *Common) int {
+	// direct address
+	if c.mod == 0b00 && c.rm == 0b110 {
+		return 6
+	}
+
+	// mod=01 counts even if the displacement is 0, e.g. `[bp]`
+	hasDisp := c.mod == 0b01 || c.mod == 0b10
+
+	var result int
+
+	switch c.rm {
+	// base or index
+	case 0b100, 0b101, 0b110, 0b111:
+		result = 5
+	// bx + si, bp + di
+	case 0b000, 0b011:
+		result = 7
+	// bx + di, bp + si
+	case 0b001, 0b010:
+		result = 8
+	}
+
+	if hasDisp {
+		result += 4
+	}
+
+	return result
+}
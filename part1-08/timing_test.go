@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+// `jz $+2` lands on the next instruction but is still taken
+func TestBranchToNextInstruction(t *testing.T) {
+	// the slow add lets the queue fill up past the jz
+	prog := assembleSource(t, "bits 16\nmov cx, 1\nadd word [1000], 1\nsub cx, 1\njz next\nnext:\nmov ax, 1\nmov bx, 1\n")
+
+	s := newSim(prog.code)
+	s.prefetch = newPrefetcher(false)
+
+	var jz Delta
+	for i := 0; i < 4; i++ {
+		_, delta, err := s.step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		jz = delta
+	}
+
+	if jz.clocks.base != 16 {
+		t.Errorf("jz clocks: %d, want 16 for taken", jz.clocks.base)
+	}
+
+	// flushed and fetching from the target
+	if s.prefetch.queued != 0 || s.prefetch.fetchAddr != 0xd {
+		t.Errorf("prefetch queue after jz: %d bytes up to 0x%x, want empty at 0xd", s.prefetch.queued, s.prefetch.fetchAddr)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// text mode video and the int 10h BIOS services
+//
+// The screen is 80x25 cells of a character and an attribute byte, at
+// B800:0000 for CGA (mode 3) and B000:0000 for MDA (mode 7). Programs
+// write the buffer directly or call int 10h, which is emulated here
+// instead of running BIOS code. The buffer is rendered to the terminal
+// with ANSI escape sequences, once at the end or redrawn in place while
+// the program runs.
+
+const (
+	textColumns = 80
+	textRows    = 25
+
+	cgaTextAddr = 0xb8000
+	mdaTextAddr = 0xb0000
+
+	// light gray on black
+	defaultAttr = 0x07
+)
+
+type Video struct {
+	// 3 for CGA color text, 7 for MDA
+	mode byte
+	// cursor position
+	row, col int
+}
+
+func (v *Video) textAddr() int {
+	if v.mode == 7 {
+		return mdaTextAddr
+	}
+	return cgaTextAddr
+}
+
+// address of the cell in the text buffer
+func (v *Video) cellAddr(row, col int) int {
+	return v.textAddr() + (row*textColumns+col)*2
+}
+
+// blank screen as left by the BIOS at boot, not recorded as writes
+func (s *Sim) initVideo(mode byte) {
+	s.video = Video{mode: mode}
+
+	for i := 0; i < textRows*textColumns; i++ {
+		s.pokeMem(s.video.textAddr()+i*2, defaultAttr<<8|' ', 1)
+	}
+}
+
+// int 10h, the function is in ah
+func (s *Sim) videoService() error {
+	v := &s.video
+	ah := s.getReg(4, 0)
+	al := s.getReg(0, 0)
+
+	switch ah {
+	// set video mode, clears the screen
+	case 0x00:
+		{
+			if al != 3 && al != 7 {
+				return fmt.Errorf("int 10h: unsupported video mode %d", al)
+			}
+
+			v.mode = byte(al)
+			v.row, v.col = 0, 0
+			s.scrollUp(0, 0, 0, textRows-1, textColumns-1, defaultAttr)
+		}
+	// set cursor position, dh = row, dl = column
+	case 0x02:
+		{
+			row, col := int(s.getReg(6, 0)), int(s.getReg(2, 0))
+			v.row, v.col = min(row, textRows-1), min(col, textColumns-1)
+		}
+	// get cursor position and shape
+	case 0x03:
+		{
+			s.regs[2] = uint16(v.row)<<8 | uint16(v.col)
+			s.regs[1] = 0x0607
+		}
+	// scroll up window, al lines (0 clears), bh attribute, ch:cl to dh:dl
+	case 0x06:
+		{
+			top, left := int(s.getReg(5, 0)), int(s.getReg(1, 0))
+			bottom, right := int(s.getReg(6, 0)), int(s.getReg(2, 0))
+			bottom, right = min(bottom, textRows-1), min(right, textColumns-1)
+
+			s.scrollUp(int(al), top, left, bottom, right, byte(s.getReg(7, 0)))
+		}
+	// write character al with attribute bl cx times at the cursor
+	case 0x09:
+		s.writeChars(byte(al), int(s.getReg(3, 0)), int(s.regs[1]))
+	// write character al cx times at the cursor, keep the attributes
+	case 0x0a:
+		s.writeChars(byte(al), -1, int(s.regs[1]))
+	// teletype output of al
+	case 0x0e:
+		s.teletype(byte(al))
+	// get video mode, ah = columns, bh = page
+	case 0x0f:
+		{
+			s.regs[0] = textColumns<<8 | uint16(v.mode)
+			s.setReg(7, 0, 0)
+		}
+	default:
+		return fmt.Errorf("int 10h: unsupported function ah=%02xh", ah)
+	}
+
+	return nil
+}
+
+// attr < 0 keeps the existing attributes, doesn't move the cursor
+func (s *Sim) writeChars(c byte, attr int, count int) {
+	v := &s.video
+	offset := v.row*textColumns + v.col
+
+	for i := 0; i < count && offset+i < textRows*textColumns; i++ {
+		addr := v.textAddr() + (offset+i)*2
+
+		s.writeMem(addr, uint16(c), 0)
+		if attr >= 0 {
+			s.writeMem(addr+1, uint16(attr), 0)
+		}
+	}
+}
+
+// write a character at the cursor and advance it, scroll at the bottom
+func (s *Sim) teletype(c byte) {
+	v := &s.video
+
+	switch c {
+	// bell
+	case 0x07:
+	case '\b':
+		if v.col > 0 {
+			v.col -= 1
+		}
+	case '\r':
+		v.col = 0
+	case '\n':
+		v.row += 1
+	default:
+		{
+			s.writeMem(v.cellAddr(v.row, v.col), uint16(c), 0)
+			v.col += 1
+
+			if v.col == textColumns {
+				v.col = 0
+				v.row += 1
+			}
+		}
+	}
+
+	if v.row == textRows {
+		v.row = textRows - 1
+		s.scrollUp(1, 0, 0, textRows-1, textColumns-1, defaultAttr)
+	}
+}
+
+// scroll the window up by n lines, 0 clears it, new lines get attr
+func (s *Sim) scrollUp(n int, top, left, bottom, right int, attr byte) {
+	v := &s.video
+
+	if n == 0 || n > bottom-top {
+		n = bottom - top + 1
+	}
+
+	for row := top; row <= bottom; row++ {
+		for col := left; col <= right; col++ {
+			cell := uint16(attr)<<8 | ' '
+
+			if row+n <= bottom {
+				cell = s.peekMem(v.cellAddr(row+n, col), 1)
+			}
+
+			if s.peekMem(v.cellAddr(row, col), 1) != cell {
+				s.writeMem(v.cellAddr(row, col), cell, 1)
+			}
+		}
+	}
+}
+
+// CGA color index to ANSI color index
+var ansiColors = [8]int{0, 4, 2, 6, 1, 5, 3, 7}
+
+// SGR parameters of a text attribute
+func textAttrSGR(attr byte, mda bool) string {
+	if !mda {
+		fg, bg := attr&0b1111, (attr>>4)&0b111
+
+		code := 30 + ansiColors[fg&0b111]
+		if fg >= 8 {
+			code = 90 + ansiColors[fg&0b111]
+		}
+
+		return fmt.Sprintf("%d;%d", code, 40+ansiColors[bg])
+	}
+
+	var parts []string
+
+	switch attr & 0x77 {
+	// invisible
+	case 0x00:
+		return "8"
+	case 0x70:
+		parts = append(parts, "7")
+	case 0x01:
+		parts = append(parts, "4")
+	}
+
+	if attr&0x08 != 0 {
+		parts = append(parts, "1")
+	}
+
+	if len(parts) == 0 {
+		return "0"
+	}
+
+	return "0;" + strings.Join(parts, ";")
+}
+
+// the text buffer with ANSI colors, trailing blank cells are left out
+func (s *Sim) renderScreen(w io.Writer) {
+	v := &s.video
+	mda := v.mode == 7
+
+	for row := 0; row < textRows; row++ {
+		// trailing spaces on black
+		end := textColumns
+		for end > 0 {
+			cell := s.peekMem(v.cellAddr(row, end-1), 1)
+			c, attr := byte(cell), byte(cell>>8)
+
+			if (c != 0 && c != ' ') || (attr&0x70 != 0 && !mda) || (attr&0x77 == 0x70 && mda) {
+				break
+			}
+			end -= 1
+		}
+
+		b := new(strings.Builder)
+		last := -1
+
+		for col := 0; col < end; col++ {
+			cell := s.peekMem(v.cellAddr(row, col), 1)
+			c, attr := byte(cell), byte(cell>>8)
+
+			if int(attr) != last {
+				fmt.Fprintf(b, "\x1b[%sm", textAttrSGR(attr, mda))
+				last = int(attr)
+			}
+
+			b.WriteRune(CP437[c])
+		}
+
+		if end > 0 {
+			b.WriteString("\x1b[0m")
+		}
+
+		fmt.Fprintln(w, b.String())
+	}
+}
+
+// the text buffer is compared with the last drawn one every this many
+// instructions, and drawn again at most 30 times a second
+const (
+	liveScreenSteps    = 1024
+	liveScreenInterval = time.Second / 30
+)
+
+// redraws the screen in place while the program runs
+type LiveScreen struct {
+	w     io.Writer
+	steps int
+	// text buffer as last drawn
+	drawn []byte
+	last  time.Time
+}
+
+func newLiveScreen(w io.Writer) *LiveScreen {
+	return &LiveScreen{w: w}
+}
+
+// after every instruction
+func (l *LiveScreen) update(s *Sim) {
+	l.steps += 1
+	if l.steps%liveScreenSteps != 0 || time.Since(l.last) < liveScreenInterval {
+		return
+	}
+
+	l.draw(s)
+}
+
+// draw the screen if it changed since the last time
+func (l *LiveScreen) draw(s *Sim) {
+	addr := s.video.textAddr()
+	buf := s.mem[addr : addr+textRows*textColumns*2]
+
+	if l.drawn != nil && bytes.Equal(buf, l.drawn) {
+		return
+	}
+
+	l.drawn = append(l.drawn[:0], buf...)
+	l.last = time.Now()
+
+	// cursor home and clear, rows leave out trailing blanks
+	fmt.Fprint(l.w, "\x1b[H\x1b[J")
+	s.renderScreen(l.w)
+}
+
+// code page 437, control characters as their glyphs
+var CP437 = []rune(
+	" ☺☻♥♦♣♠•◘○◙♂♀♪♫☼►◄↕‼¶§▬↨↑↓→←∟↔▲▼" +
+		" !\"#$%&'()*+,-./0123456789:;<=>?" +
+		"@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_" +
+		"`abcdefghijklmnopqrstuvwxyz{|}~⌂" +
+		"ÇüéâäàåçêëèïîìÄÅÉæÆôöòûùÿÖÜ¢£¥₧ƒ" +
+		"áíóúñÑªº¿⌐¬½¼¡«»░▒▓│┤╡╢╖╕╣║╗╝╜╛┐" +
+		"└┴┬├─┼╞╟╚╔╩╦╠═╬╧╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+		"αßΓπΣσµτΦΘΩδ∞φε∩≡±≥≤⌠⌡÷≈°∙·√ⁿ²■\u00a0")
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// teletype `Hi` through int 10h
+const teletypeHi = `bits 16
+mov ah, 0x0e
+mov al, 72
+int 0x10
+mov al, 105
+int 0x10
+`
+
+func TestLiveScreen(t *testing.T) {
+	s := newSim(assembleSource(t, teletypeHi).code)
+	s.initVideo(3)
+
+	out := &bytes.Buffer{}
+	live := newLiveScreen(out)
+
+	// drawn on the 1024th instruction at the earliest
+	for i := 0; i < liveScreenSteps-1; i++ {
+		live.update(s)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("drawn before %d instructions", liveScreenSteps)
+	}
+
+	live.update(s)
+	if !strings.HasPrefix(out.String(), "\x1b[H\x1b[J") {
+		t.Fatalf("no redraw: %q", out.String())
+	}
+
+	// nothing changed
+	out.Reset()
+	live.draw(s)
+	if out.Len() != 0 {
+		t.Fatalf("drawn again without changes: %q", out.String())
+	}
+
+	runSim(t, s)
+	live.draw(s)
+
+	first, _, _ := strings.Cut(strings.TrimPrefix(out.String(), "\x1b[H\x1b[J"), "\n")
+	if !strings.Contains(first, "Hi") {
+		t.Errorf("first row %q, want Hi", first)
+	}
+}
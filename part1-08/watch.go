@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// watchpoints, checked at the end of `Sim.exec`
+//
+// Memory watchpoints cover a range of physical addresses and trigger on
+// operand reads and writes of the instruction, execute watchpoints on the
+// next instruction starting in the range, so the program stops before
+// running it. Register watchpoints trigger when the value changes, the
+// 8-bit registers are watched as part of the 16-bit one.
+
+type WatchKind byte
+
+const (
+	Watch_Read WatchKind = 1 << iota
+	Watch_Write
+	Watch_Execute
+)
+
+func (k WatchKind) String() string {
+	result := ""
+
+	if k&Watch_Read != 0 {
+		result += "r"
+	}
+	if k&Watch_Write != 0 {
+		result += "w"
+	}
+	if k&Watch_Execute != 0 {
+		result += "x"
+	}
+
+	return result
+}
+
+type Watchpoint struct {
+	id   int
+	kind WatchKind
+
+	// memory range [addr, addr+size)
+	addr int
+	size int
+
+	// register watchpoint if reg >= 0, index into Sim.regs or Sim.sregs
+	reg int
+	seg bool
+
+	// triggers only if the condition holds after the instruction, nil for always
+	cond     Expr
+	condText string
+}
+
+// `0x00100,2` or `cx`
+func (w *Watchpoint) target() string {
+	if w.reg >= 0 {
+		if w.seg {
+			return SEGMENT_REGISTERS[w.reg]
+		}
+		return REGISTERS_16[w.reg]
+	}
+
+	return fmt.Sprintf("0x%05x,%d", w.addr, w.size)
+}
+
+func (w *Watchpoint) String() string {
+	result := fmt.Sprintf("%d: %s %s", w.id, w.kind, w.target())
+
+	if w.cond != nil {
+		result += " if " + w.condText
+	}
+
+	return result
+}
+
+// whether [addr, addr+size) overlaps the watched range
+func (w *Watchpoint) covers(addr int, size int) bool {
+	return w.reg < 0 && addr < w.addr+w.size && w.addr < addr+size
+}
+
+type WatchHit struct {
+	wp   *Watchpoint
+	kind WatchKind
+	// accessed address, or the register
+	addr     int
+	old, new uint16
+}
+
+// e.g. `watchpoint 1: write 0x00100 0x0->0x12`
+func (h *WatchHit) String() string {
+	switch true {
+	case h.kind == Watch_Execute:
+		return fmt.Sprintf("watchpoint %d: execute 0x%05x", h.wp.id, h.addr)
+	case h.kind == Watch_Read:
+		return fmt.Sprintf("watchpoint %d: read 0x%05x 0x%x", h.wp.id, h.addr, h.new)
+	case h.wp.reg >= 0:
+		return fmt.Sprintf("watchpoint %d: write %s 0x%x->0x%x", h.wp.id, h.wp.target(), h.old, h.new)
+	}
+
+	return fmt.Sprintf("watchpoint %d: write 0x%05x 0x%x->0x%x", h.wp.id, h.addr, h.old, h.new)
+}
+
+// register index by name, 8-bit registers give the 16-bit one, -1 if unknown
+func registerIndex(name string) (int, bool) {
+	name = strings.ToLower(name)
+
+	if idx := indexOf(REGISTERS_16, name); idx >= 0 {
+		return idx, false
+	}
+	if idx := indexOf(REGISTERS_8, name); idx >= 0 {
+		return idx % 4, false
+	}
+	if idx := indexOf(SEGMENT_REGISTERS, name); idx >= 0 {
+		return idx, true
+	}
+
+	return -1, false
+}
+
+func (s *Sim) addWatchpoint(w *Watchpoint) {
+	s.nextWatchID += 1
+	w.id = s.nextWatchID
+	s.watchpoints = append(s.watchpoints, w)
+}
+
+// return false if there is no such watchpoint
+func (s *Sim) deleteWatchpoint(id int) bool {
+	for idx, w := range s.watchpoints {
+		if w.id == id {
+			s.watchpoints = append(s.watchpoints[:idx], s.watchpoints[idx+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// fill s.watchHits for the instruction which made the delta
+func (s *Sim) checkWatchpoints(d *Delta) {
+	for _, w := range s.watchpoints {
+		if w.cond != nil && w.cond(s) == 0 {
+			continue
+		}
+
+		if w.reg >= 0 {
+			for _, r := range d.regs {
+				if int(r.reg) == w.reg && r.seg == w.seg {
+					s.watchHits = append(s.watchHits, WatchHit{w, Watch_Write, w.reg, r.old, r.new})
+				}
+			}
+			continue
+		}
+
+		if w.kind&Watch_Read != 0 {
+			for _, r := range s.memReads {
+				if w.covers(r.addr, int(r.wide)+1) {
+					s.watchHits = append(s.watchHits, WatchHit{w, Watch_Read, r.addr, 0, s.peekMem(r.addr, r.wide)})
+				}
+			}
+		}
+
+		if w.kind&Watch_Write != 0 {
+			for _, m := range d.mem {
+				if w.covers(m.addr, int(m.wide)+1) {
+					s.watchHits = append(s.watchHits, WatchHit{w, Watch_Write, m.addr, m.old, m.new})
+				}
+			}
+		}
+
+		if w.kind&Watch_Execute != 0 && w.covers(s.ip, 1) {
+			s.watchHits = append(s.watchHits, WatchHit{w, Watch_Execute, s.ip, 0, 0})
+		}
+	}
+}